@@ -2,9 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -45,6 +47,13 @@ func extractImages(doc *goquery.Document) []string {
 	return imageURLs
 }
 
+// アカウント名に使える文字はアプリケーションの登録時の検証と同じ
+var accountNameRegexp = regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`)
+
+func userPagePath(accountName string) string {
+	return "/@" + url.PathEscape(accountName)
+}
+
 func extractPostLinks(doc *goquery.Document) []string {
 	postLinks := []string{}
 
@@ -67,7 +76,7 @@ func loadAssets(s *checker.Session) {
 	a.Description = "timeago.min.jsが読み込めること"
 	a.Play(s)
 
-	a = checker.NewAssetAction("/js/main.js", &checker.Asset{MD5: "9c309fed7e360c57a705978dab2c68ad"})
+	a = checker.NewAssetAction("/js/main.js", &checker.Asset{MD5: "8c368acba1d0434e5f00cc9eac3ee4f9"})
 	a.Description = "main.jsが読み込めること"
 	a.Play(s)
 
@@ -175,12 +184,27 @@ func userAndPostPageScenario(s *checker.Session, accountName string) {
 	var postLinks []string
 	start := time.Now()
 
-	userPage := checker.NewAction("GET", "/@"+accountName)
+	if !accountNameRegexp.MatchString(accountName) {
+		// ユーザーデータの不備なので減点はしないが、チェックが行われなかったことは結果に残す
+		s.Fail(0, nil, fmt.Errorf("ユーザーデータのアカウント名 %q が不正です (主催者に連絡してください)", accountName))
+		return
+	}
+
+	userPage := checker.NewAction("GET", userPagePath(accountName))
 	userPage.Description = "ユーザーページ"
 	userPage.CheckFunc = checkHTML(func(doc *goquery.Document) error {
 		imageURLs = extractImages(doc)
 		postLinks = extractPostLinks(doc)
-		return nil
+
+		var err error
+		doc.Find("div.isu-post-header a.isu-post-account-name").EachWithBreak(func(_ int, selection *goquery.Selection) bool {
+			if href, _ := selection.Attr("href"); href != userPagePath(accountName) {
+				err = errors.New("投稿者のリンクがユーザーページを指していません")
+				return false
+			}
+			return true
+		})
+		return err
 	})
 	err := userPage.Play(s)
 	if err != nil {
@@ -233,7 +257,7 @@ func commentScenario(s *checker.Session, me user, accountName string, sentence s
 		return
 	}
 
-	userPage := checker.NewAction("GET", "/@"+accountName)
+	userPage := checker.NewAction("GET", userPagePath(accountName))
 	userPage.Description = "ユーザーページが表示できること"
 	userPage.CheckFunc = checkHTML(func(doc *goquery.Document) error {
 
@@ -2,3 +2,10 @@ PATH=/usr/local/bin:/home/isucon/.local/ruby/bin:/home/isucon/.local/node/bin:/h
 ISUCONP_DB_USER=isuconp
 ISUCONP_DB_PASSWORD=isuconp
 ISUCONP_DB_NAME=isuconp
+# ログイン失敗の制限。有効にするときは、ベンチマーカーのアドレスを除外する
+#ISUCONP_LOGIN_LIMIT=on
+#ISUCONP_LOGIN_LIMIT_EXEMPT_NETS=
+# superadmin にするアカウント名 (カンマ区切り)
+#ISUCONP_SUPERADMINS=
+# 画像の保存先 (local, db, s3)
+#ISUCONP_IMAGE_STORE=local
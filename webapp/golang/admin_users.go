@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// /admin/banned のユーザー一覧。アカウント名の前方一致で絞り込み、登録日時か投稿数で並べてページに分ける。
+// ページをまたいだ選択はセッションの banSelectionKey に持ち、ページを移るときに今のページのチェックを反映する。
+
+const (
+	adminUsersPerPage = 100
+
+	adminUserSortCreated = "created"
+	adminUserSortPosts   = "posts"
+
+	banSelectionKey = "ban_selection"
+	// セッションに持つ選択の上限。Cookie にセッションを置くときも 4096 バイトに収まるように2ページ分にする
+	banSelectionLimit = 200
+)
+
+// AdminUser は BANするユーザーの一覧に出すユーザー
+type AdminUser struct {
+	User
+	PostCount int `db:"post_count"`
+	Selected  bool
+}
+
+// adminUserQuery は /admin/banned の絞り込みと並び順とページ
+type adminUserQuery struct {
+	Prefix string
+	Sort   string
+	Page   int
+}
+
+func parseAdminUserQuery(q url.Values) adminUserQuery {
+	a := adminUserQuery{
+		Prefix: strings.TrimSpace(q.Get("q")),
+		Sort:   q.Get("sort"),
+	}
+	if a.Sort != adminUserSortPosts {
+		a.Sort = adminUserSortCreated
+	}
+	a.Page, _ = strconv.Atoi(q.Get("page"))
+	if a.Page < 1 {
+		a.Page = 1
+	}
+	return a
+}
+
+// build はページのユーザーを取る SQL を返す。次のページがあるか分かるように1件多く取る
+func (a adminUserQuery) build() (string, []interface{}) {
+	args := []interface{}{}
+
+	// 登録日時で並べるときの投稿数は、ページが決まってから countUserPosts で数える
+	query := "SELECT `users`.* FROM `users`"
+	if a.Sort == adminUserSortPosts {
+		// 全員の投稿数で並べるので先にまとめて数える
+		query = "SELECT `users`.*, COALESCE(`counts`.`post_count`, 0) AS `post_count` FROM `users` " +
+			"LEFT JOIN (SELECT `user_id`, COUNT(*) AS `post_count` FROM `posts` GROUP BY `user_id`) AS `counts` ON `counts`.`user_id` = `users`.`id`"
+	}
+
+	query += " WHERE `users`.`authority` = 0 AND " + activeUserCondition
+	if a.Prefix != "" {
+		query += " AND `users`.`account_name` LIKE ?"
+		args = append(args, likePrefix(a.Prefix))
+	}
+
+	if a.Sort == adminUserSortPosts {
+		query += " ORDER BY `post_count` DESC, `users`.`id` DESC"
+	} else {
+		query += " ORDER BY `users`.`created_at` DESC, `users`.`id` DESC"
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, adminUsersPerPage+1, (a.Page-1)*adminUsersPerPage)
+	return query, args
+}
+
+// values は page のページへのリンクに使うクエリ文字列を返す
+func (a adminUserQuery) values(page int) url.Values {
+	v := url.Values{}
+	if a.Prefix != "" {
+		v.Set("q", a.Prefix)
+	}
+	if a.Sort != adminUserSortCreated {
+		v.Set("sort", a.Sort)
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	return v
+}
+
+func (a adminUserQuery) url(page int) string {
+	if v := a.values(page); len(v) > 0 {
+		return "/admin/banned?" + v.Encode()
+	}
+	return "/admin/banned"
+}
+
+// likePrefix は s で始まる文字列に一致する LIKE のパターンを返す
+func likePrefix(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s) + "%"
+}
+
+// selectAdminUsers はページのユーザーと、次のページがあるかを返す
+func selectAdminUsers(a adminUserQuery, selection []string) ([]AdminUser, bool, error) {
+	users := []AdminUser{}
+	query, args := a.build()
+	if err := db.Select(&users, query, args...); err != nil {
+		return nil, false, err
+	}
+
+	hasNext := len(users) > adminUsersPerPage
+	if hasNext {
+		users = users[:adminUsersPerPage]
+	}
+
+	if a.Sort != adminUserSortPosts && len(users) > 0 {
+		ids := make([]int, 0, len(users))
+		for _, u := range users {
+			ids = append(ids, u.ID)
+		}
+		counts, err := countUserPosts(ids)
+		if err != nil {
+			return nil, false, err
+		}
+		for i := range users {
+			users[i].PostCount = counts[users[i].ID]
+		}
+	}
+
+	for i := range users {
+		users[i].Selected = slices.Contains(selection, strconv.Itoa(users[i].ID))
+	}
+	return users, hasNext, nil
+}
+
+// countUserPosts はユーザーごとの投稿数をまとめて数える
+func countUserPosts(ids []int) (map[int]int, error) {
+	query, args, err := sqlx.In("SELECT `user_id`, COUNT(*) AS `post_count` FROM `posts` WHERE `user_id` IN (?) GROUP BY `user_id`", ids)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		UserID    int `db:"user_id"`
+		PostCount int `db:"post_count"`
+	}{}
+	if err := db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[int]int, len(rows))
+	for _, r := range rows {
+		counts[r.UserID] = r.PostCount
+	}
+	return counts, nil
+}
+
+// mergeSelection は選択中の ID から今のページの ID を除き、今のページでチェックされた ID を足す
+func mergeSelection(selection, page, checked []string) []string {
+	merged := []string{}
+	for _, id := range selection {
+		if !slices.Contains(page, id) {
+			merged = append(merged, id)
+		}
+	}
+	for _, id := range checked {
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		id = strconv.Itoa(uid)
+		if !slices.Contains(merged, id) {
+			merged = append(merged, id)
+		}
+	}
+	if len(merged) > banSelectionLimit {
+		merged = merged[:banSelectionLimit]
+	}
+	return merged
+}
+
+func getBanSelection(r *http.Request) []string {
+	ids, _ := getSession(r).Values[banSelectionKey].([]string)
+	return ids
+}
+
+func saveBanSelection(w http.ResponseWriter, r *http.Request, ids []string) error {
+	session := getSession(r)
+	if len(ids) == 0 {
+		delete(session.Values, banSelectionKey)
+	} else {
+		session.Values[banSelectionKey] = ids
+	}
+	return session.Save(r, w)
+}
+
+// postAdminBannedSelect は今のページのチェックを選択に反映し、page のページに移る
+func postAdminBannedSelect(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	selection := []string(nil)
+	if r.FormValue("clear") == "" {
+		selection = mergeSelection(getBanSelection(r), r.Form["page_uid[]"], r.Form["uid[]"])
+	}
+	if err := saveBanSelection(w, r, selection); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	a := parseAdminUserQuery(r.Form)
+	http.Redirect(w, r, a.url(a.Page), http.StatusFound)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestAdminUserQuery(t *testing.T) {
+	a := parseAdminUserQuery(url.Values{"q": {" ab_"}, "sort": {"posts"}, "page": {"3"}})
+	if a.Prefix != "ab_" || a.Sort != adminUserSortPosts || a.Page != 3 {
+		t.Fatalf("unexpected query %+v", a)
+	}
+
+	query, args := a.build()
+	if !strings.Contains(query, "ORDER BY `post_count` DESC") {
+		t.Errorf("expected query to sort by post count: %s", query)
+	}
+	want := []interface{}{`ab\_%`, adminUsersPerPage + 1, 2 * adminUsersPerPage}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("expected args %v to eq %v", args, want)
+	}
+	if got := a.url(4); got != "/admin/banned?page=4&q=ab_&sort=posts" {
+		t.Errorf("unexpected url %q", got)
+	}
+
+	d := parseAdminUserQuery(url.Values{"sort": {"unknown"}, "page": {"-1"}})
+	if d.Sort != adminUserSortCreated || d.Page != 1 || d.url(1) != "/admin/banned" {
+		t.Errorf("unexpected default query %+v", d)
+	}
+	// 登録日時順では全員の投稿を数えない
+	if query, _ := d.build(); strings.Contains(query, "`posts`") {
+		t.Errorf("expected the default query not to touch posts: %s", query)
+	}
+}
+
+func TestMergeSelection(t *testing.T) {
+	got := mergeSelection([]string{"1", "2", "3"}, []string{"2", "3", "4"}, []string{"3", "4", "x", "04"})
+	want := []string{"1", "3", "4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v to eq %v", got, want)
+	}
+}
+
+func TestBanSelectionFitsInCookie(t *testing.T) {
+	store := sessions.NewCookieStore(sessionKeyPairs([]string{"secret"}, true)...)
+	r := httptest.NewRequest("POST", "/admin/banned/select", nil)
+	session, err := store.New(r, "isuconp-go.session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user_id"] = 1
+	session.Values["csrf_token"] = strings.Repeat("0", 64)
+	session.Values["sid"] = strings.Repeat("0", 43)
+
+	// 上限まで選んでも Cookie の 4096 バイトに収まる
+	ids := []string{}
+	for i := 0; i < banSelectionLimit; i++ {
+		ids = append(ids, strconv.Itoa(1000000+i))
+	}
+	session.Values[banSelectionKey] = ids
+	if err := store.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Errorf("expected %d selected ids to fit in a cookie: %s", banSelectionLimit, err)
+	}
+}
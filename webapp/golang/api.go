@@ -0,0 +1,776 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// /api/v1 以下のJSON API。HTMLのハンドラと同じデータアクセスを使う。
+// セッションで認証した書き込みには X-CSRF-Token ヘッダが必要。
+// Authorization: Bearer のアクセストークンで認証したときは CSRF トークンは不要。
+
+type apiUser struct {
+	ID          int       `json:"id"`
+	AccountName string    `json:"account_name"`
+	Authority   int       `json:"authority"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type apiUserProfile struct {
+	apiUser
+	PostCount      int `json:"post_count"`
+	CommentCount   int `json:"comment_count"`
+	CommentedCount int `json:"commented_count"`
+}
+
+type apiComment struct {
+	Comment    string `json:"comment"`
+	AuthorName string `json:"author_name"`
+}
+
+type apiPost struct {
+	ID                 int          `json:"id"`
+	User               apiUser      `json:"user"`
+	Body               string       `json:"body"`
+	Mime               string       `json:"mime"`
+	ImageURL           string       `json:"image_url"`
+	CreatedAt          time.Time    `json:"created_at"`
+	CommentCount       int          `json:"comment_count"`
+	Comments           []apiComment `json:"comments"`
+	CommentsNextCursor string       `json:"comments_next_cursor,omitempty"`
+}
+
+type apiPostsPage struct {
+	Posts      []apiPost `json:"posts"`
+	NextCursor string    `json:"next_cursor"`
+}
+
+type apiCommentsPage struct {
+	Comments   []apiComment `json:"comments"`
+	NextCursor string       `json:"next_cursor"`
+}
+
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newAPIUser(u User) apiUser {
+	return apiUser{
+		ID:          u.ID,
+		AccountName: u.AccountName,
+		Authority:   u.Authority,
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+func newAPIComments(comments []Comment) []apiComment {
+	res := make([]apiComment, 0, len(comments))
+	for _, c := range comments {
+		res = append(res, apiComment{Comment: c.Comment, AuthorName: c.AuthorName})
+	}
+	return res
+}
+
+func newAPIPost(p Post) apiPost {
+	return apiPost{
+		ID:                 p.ID,
+		User:               newAPIUser(p.User),
+		Body:               p.Body,
+		Mime:               p.Mime,
+		ImageURL:           imageURL(p),
+		CreatedAt:          p.CreatedAt,
+		CommentCount:       p.CommentCount,
+		Comments:           newAPIComments(p.Comments),
+		CommentsNextCursor: p.CommentsNextCursor,
+	}
+}
+
+func newAPIPostsPage(posts []Post, limit int) apiPostsPage {
+	page := apiPostsPage{
+		Posts:      make([]apiPost, 0, len(posts)),
+		NextCursor: nextTimelineCursor(posts, limit),
+	}
+	for _, p := range posts {
+		page.Posts = append(page.Posts, newAPIPost(p))
+	}
+	return page
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiErrorBody{Error: apiError{Code: code, Message: message}})
+}
+
+func writeAPIInternalError(w http.ResponseWriter, err error) {
+	log.Print(err)
+	writeAPIError(w, http.StatusInternalServerError, "internal_error", "内部エラーが発生しました")
+}
+
+// apiAuthenticate はトークンかセッションで認証したユーザーを返す。
+// トークンは scope を持っている必要があり、tokenScopeNone のときはセッションでしか認証できない。
+// セッションでの書き込みは CSRF トークンも確かめる。失敗したらエラーを書いて false を返す。
+func apiAuthenticate(w http.ResponseWriter, r *http.Request, scope tokenScope) (User, bool) {
+	me, tokenAuth, err := getRequestUser(r, scope)
+	if tokenAuth {
+		switch {
+		case errors.Is(err, errAccessTokenScope):
+			writeAPIError(w, http.StatusForbidden, "insufficient_scope", "トークンにこの操作の権限がありません")
+			return User{}, false
+		case errors.Is(err, errAccessTokenInvalid):
+			writeAPIError(w, http.StatusUnauthorized, "invalid_token", "トークンが正しくありません")
+			return User{}, false
+		case err != nil:
+			writeAPIInternalError(w, err)
+			return User{}, false
+		}
+		return me, true
+	}
+
+	if !isLogin(me) {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "ログインが必要です")
+		return User{}, false
+	}
+
+	if scope != tokenScopeRead {
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" || token != getCSRFToken(r) {
+			writeAPIError(w, http.StatusUnprocessableEntity, "invalid_csrf_token", "CSRFトークンが正しくありません")
+			return User{}, false
+		}
+	}
+
+	return me, true
+}
+
+// apiRequirePermission は p の権限を持ち、必要なら2段階認証を有効にしているかを確かめる
+func apiRequirePermission(w http.ResponseWriter, me User, p permission) bool {
+	ok, err := hasPermission(me, p)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return false
+	}
+	if !ok {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "この操作を行う権限がありません")
+		return false
+	}
+	needs, err := needsTwoFactorEnrollment(me)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return false
+	}
+	if needs {
+		writeAPIError(w, http.StatusForbidden, "two_factor_required", errTwoFactorRequired.Error())
+		return false
+	}
+	return true
+}
+
+func apiPostIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	pid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "投稿が見つかりません")
+		return 0, false
+	}
+	return pid, true
+}
+
+func apiCursorParam(w http.ResponseWriter, r *http.Request) (*timelineCursor, bool) {
+	s := r.URL.Query().Get("cursor")
+	if s == "" {
+		return nil, true
+	}
+	c, err := decodeTimelineCursor(s)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_cursor", "cursorが正しくありません")
+		return nil, false
+	}
+	return c, true
+}
+
+func apiRoutes(r chi.Router) {
+	r.Get("/posts", apiGetPosts)
+	r.Post("/posts", apiPostPosts)
+	r.Get("/posts/{id}", apiGetPostsID)
+	r.Get("/posts/{id}/comments", apiGetPostsIDComments)
+	r.Post("/posts/{id}/comments", apiPostPostsIDComments)
+	r.Get(`/users/{accountName:`+accountNamePattern+`}`, apiGetUser)
+	r.Get(`/users/{accountName:`+accountNamePattern+`}/posts`, apiGetUserPosts)
+	r.Get("/session", apiGetSession)
+	r.Post("/session", apiPostSession)
+	r.Delete("/session", apiDeleteSession)
+	r.Post("/admin/banned", apiPostAdminBanned)
+	r.Get("/admin/bans", apiGetAdminBans)
+	r.Delete("/admin/bans/{userID}", apiDeleteAdminBan)
+	r.Get("/admin/password-report", apiGetAdminPasswordReport)
+	r.Get("/tokens", apiGetTokens)
+	r.Post("/tokens", apiPostTokens)
+	r.Delete("/tokens/{id}", apiDeleteToken)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "見つかりません")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "許可されていないメソッドです")
+	})
+}
+
+func apiGetPosts(w http.ResponseWriter, r *http.Request) {
+	before, ok := apiCursorParam(w, r)
+	if !ok {
+		return
+	}
+
+	q := timelineQuery{
+		Before:          before,
+		CommentsPerPost: commentsPerPost,
+		Limit:           postsPerPage,
+	}
+	posts, err := selectTimeline(q, "")
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIPostsPage(posts, q.Limit))
+}
+
+func apiGetPostsID(w http.ResponseWriter, r *http.Request) {
+	pid, ok := apiPostIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	posts, err := selectTimeline(timelineQuery{
+		PostID:          pid,
+		CommentsPerPost: 1,
+		Limit:           1,
+	}, "")
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+	if len(posts) == 0 {
+		writeAPIError(w, http.StatusNotFound, "not_found", "投稿が見つかりません")
+		return
+	}
+
+	p := posts[0]
+	p.Comments, p.CommentsNextCursor, err = selectComments(commentQuery{
+		PostID: p.ID,
+		Order:  postComments.order,
+		Limit:  postComments.perPage,
+	})
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIPost(p))
+}
+
+func apiGetPostsIDComments(w http.ResponseWriter, r *http.Request) {
+	pid, ok := apiPostIDParam(w, r)
+	if !ok {
+		return
+	}
+	after, ok := apiCursorParam(w, r)
+	if !ok {
+		return
+	}
+
+	exists, err := postExists(pid)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+	if !exists {
+		writeAPIError(w, http.StatusNotFound, "not_found", "投稿が見つかりません")
+		return
+	}
+
+	comments, next, err := selectComments(commentQuery{
+		PostID: pid,
+		Order:  postComments.order,
+		After:  after,
+		Limit:  postComments.perPage,
+	})
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiCommentsPage{Comments: newAPIComments(comments), NextCursor: next})
+}
+
+func apiUserPath(accountName string) string {
+	return "/api/v1/users/" + url.PathEscape(accountName)
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	accountName := chi.URLParam(r, "accountName")
+	user, err := getActiveUser(accountName)
+	if err == sql.ErrNoRows {
+		if redirectRenamedUser(w, r, accountName, apiUserPath) {
+			return
+		}
+		writeAPIError(w, http.StatusNotFound, "not_found", "ユーザーが見つかりません")
+		return
+	}
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	stats, err := getUserStats(user.ID)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiUserProfile{
+		apiUser:        newAPIUser(user),
+		PostCount:      stats.PostCount,
+		CommentCount:   stats.CommentCount,
+		CommentedCount: stats.CommentedCount,
+	})
+}
+
+func apiGetUserPosts(w http.ResponseWriter, r *http.Request) {
+	before, ok := apiCursorParam(w, r)
+	if !ok {
+		return
+	}
+
+	accountName := chi.URLParam(r, "accountName")
+	user, err := getActiveUser(accountName)
+	if err == sql.ErrNoRows {
+		if redirectRenamedUser(w, r, accountName, func(name string) string { return apiUserPath(name) + "/posts" }) {
+			return
+		}
+		writeAPIError(w, http.StatusNotFound, "not_found", "ユーザーが見つかりません")
+		return
+	}
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	q := timelineQuery{
+		UserID:          user.ID,
+		Before:          before,
+		CommentsPerPost: commentsPerPost,
+		Limit:           postsPerPage,
+	}
+	posts, err := selectTimeline(q, "")
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIPostsPage(posts, q.Limit))
+}
+
+// apiPostPosts は multipart/form-data の file と body を受け取って投稿する
+func apiPostPosts(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopePost)
+	if !ok {
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", errImageRequired.Error())
+		return
+	}
+	defer file.Close()
+
+	pid, err := createPost(me, file, r.FormValue("body"))
+	var verr validationError
+	if errors.As(err, &verr) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", verr.Error())
+		return
+	}
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	posts, err := selectTimeline(timelineQuery{PostID: int(pid), Limit: 1}, "")
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+	if len(posts) == 0 {
+		writeAPIInternalError(w, errors.New("created post not found"))
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/posts/"+strconv.FormatInt(pid, 10))
+	writeJSON(w, http.StatusCreated, newAPIPost(posts[0]))
+}
+
+func apiPostPostsIDComments(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeComment)
+	if !ok {
+		return
+	}
+	pid, ok := apiPostIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	params := struct {
+		Comment string `json:"comment"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Comment == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "commentが必要です")
+		return
+	}
+
+	err := createComment(me, pid, params.Comment)
+	if errors.Is(err, errCommentNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, apiComment{Comment: params.Comment, AuthorName: me.AccountName})
+}
+
+type apiSession struct {
+	User      apiUser `json:"user"`
+	CSRFToken string  `json:"csrf_token"`
+}
+
+func apiGetSession(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeRead)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiSession{User: newAPIUser(me), CSRFToken: getCSRFToken(r)})
+}
+
+// apiPostSession は account_name と password でログインし、セッションCookieを発行する
+func apiPostSession(w http.ResponseWriter, r *http.Request) {
+	params := struct {
+		AccountName string `json:"account_name"`
+		Password    string `json:"password"`
+		OTP         string `json:"otp"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "account_nameとpasswordが必要です")
+		return
+	}
+
+	ip := loginLimit.clientIP(r)
+	if retryAfter, locked := loginLimit.locked(params.AccountName, ip); locked {
+		writeAPILoginLimited(w, retryAfter)
+		return
+	}
+
+	u := tryLogin(params.AccountName, params.Password)
+	if u == nil {
+		if retryAfter, locked := loginLimit.failed(params.AccountName, ip); locked {
+			writeAPILoginLimited(w, retryAfter)
+			return
+		}
+		writeAPIError(w, http.StatusUnauthorized, "invalid_credentials", "アカウント名かパスワードが間違っています")
+		return
+	}
+
+	enabled, err := isTwoFactorEnabled(u.ID)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+	if enabled {
+		if params.OTP == "" {
+			writeAPIError(w, http.StatusUnauthorized, "otp_required", "確認コードが必要です")
+			return
+		}
+		ok, err := verifySecondFactor(u.ID, params.OTP)
+		if err != nil {
+			writeAPIInternalError(w, err)
+			return
+		}
+		if !ok {
+			if retryAfter, locked := loginLimit.failed(params.AccountName, ip); locked {
+				writeAPILoginLimited(w, retryAfter)
+				return
+			}
+			writeAPIError(w, http.StatusUnauthorized, "invalid_otp", errTwoFactorCode.Error())
+			return
+		}
+	}
+	loginLimit.succeeded(params.AccountName)
+
+	csrfToken, err := startSession(w, r, *u)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiSession{User: newAPIUser(*u), CSRFToken: csrfToken})
+}
+
+func writeAPILoginLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	writeAPIError(w, http.StatusTooManyRequests, "too_many_attempts", loginLimitedMessage)
+}
+
+func apiDeleteSession(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiAuthenticate(w, r, tokenScopeNone); !ok {
+		return
+	}
+
+	endSession(w, r)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiPostAdminBanned(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeNone)
+	if !ok {
+		return
+	}
+	if !apiRequirePermission(w, me, permBanUsers) {
+		return
+	}
+
+	params := struct {
+		UserIDs   []int      `json:"user_ids"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || len(params.UserIDs) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "user_idsが必要です")
+		return
+	}
+	if params.ExpiresAt != nil && !params.ExpiresAt.After(time.Now()) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "expires_atは未来の時刻である必要があります")
+		return
+	}
+
+	ids := make([]string, 0, len(params.UserIDs))
+	for _, id := range params.UserIDs {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	banUsers(r, me, ids, params.Reason, params.ExpiresAt)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type apiBan struct {
+	UserID      int        `json:"user_id"`
+	AccountName string     `json:"account_name"`
+	Reason      string     `json:"reason"`
+	BannedBy    *string    `json:"banned_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+func apiGetAdminBans(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeRead)
+	if !ok {
+		return
+	}
+	if !apiRequirePermission(w, me, permBanUsers) {
+		return
+	}
+
+	bans, err := listActiveBans()
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	res := make([]apiBan, 0, len(bans))
+	for _, b := range bans {
+		a := apiBan{UserID: b.UserID, AccountName: b.AccountName, Reason: b.Reason, CreatedAt: b.CreatedAt}
+		if b.AdminAccountName.Valid {
+			a.BannedBy = &b.AdminAccountName.String
+		}
+		if b.ExpiresAt.Valid {
+			a.ExpiresAt = &b.ExpiresAt.Time
+		}
+		res = append(res, a)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func apiDeleteAdminBan(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeNone)
+	if !ok {
+		return
+	}
+	if !apiRequirePermission(w, me, permBanUsers) {
+		return
+	}
+
+	uid, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "BANが見つかりません")
+		return
+	}
+	lifted, err := liftBan(r, me, uid)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+	if !lifted {
+		writeAPIError(w, http.StatusNotFound, "not_found", "BANが見つかりません")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGetAdminPasswordReport は以前の形式のパスワードハッシュが残っているアカウント数を返す
+func apiGetAdminPasswordReport(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeRead)
+	if !ok {
+		return
+	}
+	if !apiRequirePermission(w, me, permViewPasswordReport) {
+		return
+	}
+
+	report, err := getPasshashReport()
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+type apiAccessToken struct {
+	ID         int          `json:"id"`
+	Name       string       `json:"name"`
+	Scopes     []tokenScope `json:"scopes"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastUsedAt *time.Time   `json:"last_used_at"`
+	// 作成したときだけ返す
+	Token string `json:"token,omitempty"`
+}
+
+func newAPIAccessToken(t AccessToken) apiAccessToken {
+	res := apiAccessToken{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.ScopeList(),
+		CreatedAt: t.CreatedAt,
+	}
+	if t.LastUsedAt.Valid {
+		res.LastUsedAt = &t.LastUsedAt.Time
+	}
+	return res
+}
+
+// トークンの管理はセッションでのみ許可する
+func apiGetTokens(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeNone)
+	if !ok {
+		return
+	}
+
+	tokens, err := listAccessTokens(me.ID)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+
+	res := make([]apiAccessToken, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, newAPIAccessToken(t))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func apiPostTokens(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeNone)
+	if !ok {
+		return
+	}
+
+	params := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "nameとscopesが必要です")
+		return
+	}
+
+	scopes, err := parseTokenScopes(params.Scopes)
+	if err == nil {
+		var id int
+		var token string
+		id, token, err = createAccessToken(me.ID, params.Name, scopes)
+		if err == nil {
+			writeJSON(w, http.StatusCreated, apiAccessToken{
+				ID:        id,
+				Name:      strings.TrimSpace(params.Name),
+				Scopes:    scopes,
+				CreatedAt: time.Now(),
+				Token:     token,
+			})
+			return
+		}
+	}
+
+	var verr validationError
+	if errors.As(err, &verr) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", verr.Error())
+		return
+	}
+	writeAPIInternalError(w, err)
+}
+
+func apiDeleteToken(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuthenticate(w, r, tokenScopeNone)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "トークンが見つかりません")
+		return
+	}
+
+	revoked, err := revokeAccessToken(me.ID, id)
+	if err != nil {
+		writeAPIInternalError(w, err)
+		return
+	}
+	if !revoked {
+		writeAPIError(w, http.StatusNotFound, "not_found", "トークンが見つかりません")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha512"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -18,14 +19,13 @@ import (
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	txtemplate "text/template"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/sync/singleflight"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	_ "github.com/go-sql-driver/mysql"
@@ -35,15 +35,20 @@ import (
 )
 
 var (
-	db    *sqlx.DB
-	store *gsm.MemcacheStore
-	sf    = singleflight.Group{}
+	db             *sqlx.DB
+	store          sessions.Store
+	imageStore     ImageStore
+	sf             = singleflight.Group{}
+	memcacheClient = memcache.New(memcachedAddress())
+	cacheCoherence = newCoherence(memcacheClient, loadCoherenceInterval())
+	loginLimit     = newLoginLimiter(loadLoginLimitConfig(), memcacheClient)
 )
 
 const (
-	postsPerPage  = 20
-	ISO8601Format = "2006-01-02T15:04:05-07:00"
-	UploadLimit   = 10 * 1024 * 1024 // 10mb
+	postsPerPage    = 20
+	commentsPerPost = 3
+	ISO8601Format   = "2006-01-02T15:04:05-07:00"
+	UploadLimit     = 10 * 1024 * 1024 // 10mb
 )
 
 type User struct {
@@ -53,6 +58,8 @@ type User struct {
 	Authority   int       `db:"authority"`
 	DelFlg      int       `db:"del_flg"`
 	CreatedAt   time.Time `db:"created_at"`
+	// 期限付きでBANされているときの期限
+	BanExpiresAt sql.NullTime `db:"ban_expires_at"`
 }
 
 type Post struct {
@@ -66,8 +73,10 @@ type Post struct {
 	RN           int       `db:"rn"`
 	Comment      NullComment
 	Comments     []Comment
-	User         User
-	CSRFToken    string
+	// 投稿単体ページでコメントの続きがあるときだけ設定される
+	CommentsNextCursor string
+	User               User
+	CSRFToken          string
 }
 
 type NullComment struct {
@@ -88,17 +97,25 @@ type NullUser struct {
 }
 
 type Comment struct {
+	ID         int
 	Comment    string
 	AuthorName string
 }
 
-func init() {
+func memcachedAddress() string {
 	memdAddr := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
 	if memdAddr == "" {
 		memdAddr = "localhost:11211"
 	}
-	memcacheClient := memcache.New(memdAddr)
-	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
+	return memdAddr
+}
+
+func init() {
+	var err error
+	store, err = newSessionStore(memcacheClient)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
@@ -107,8 +124,17 @@ func dbInitialize() {
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
-		"UPDATE users SET del_flg = 0",
+		"UPDATE users SET del_flg = 0, ban_expires_at = NULL",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
+		"DELETE FROM bans",
+		"INSERT INTO bans (user_id, reason) SELECT id, '' FROM users WHERE del_flg = 1",
+		"DELETE FROM access_tokens",
+		"DELETE FROM two_factors",
+		"DELETE FROM recovery_codes",
+		"DELETE FROM account_name_redirects",
+		"DELETE FROM user_sessions",
+		"DELETE FROM user_roles",
+		"DELETE FROM reports",
 	}
 
 	for _, sql := range sqls {
@@ -116,54 +142,31 @@ func dbInitialize() {
 	}
 }
 
-func deleteImageFiles() {
-	files, err := os.ReadDir("/home/public/image")
-	if err != nil {
-		fmt.Println("Error reading directory:", err)
-		return
-	}
-
-	for _, file := range files {
-		fileName := file.Name()
-		parts := strings.Split(fileName, ".")
-		if len(parts) != 2 {
-			continue
-		}
-
-		idx, err := strconv.Atoi(parts[0])
-		if err != nil {
-			fmt.Println("Error converting string to integer:", err)
-			continue
-		}
-
-		if idx > 10000 {
-			err := os.Remove("/home/public/image/" + fileName)
-			if err != nil {
-				fmt.Println("Error deleting file:", err)
-			} else {
-				fmt.Println("Deleted:", fileName)
-			}
-		}
-	}
-}
-
 func tryLogin(accountName, password string) *User {
 	u := User{}
-	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
+	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND "+activeUserCondition, accountName)
 	if err != nil {
 		return nil
 	}
 
-	if calculatePasshash(u.AccountName, password) == u.Passhash {
-		return &u
-	} else {
+	ok, needsRehash := verifyPassword(u, password)
+	if !ok {
 		return nil
 	}
+	if needsRehash {
+		rehashPassword(&u, password)
+	}
+	return &u
 }
 
+// アカウント名の規則。登録時の検証とユーザーページのルーティングの両方で使う
+const accountNamePattern = `[0-9a-zA-Z_]{3,}`
+
+var accountNameRegexp = regexp.MustCompile(`\A` + accountNamePattern + `\z`)
+
 func validateUser(accountName, password string) bool {
-	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName) &&
-		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
+	return accountNameRegexp.MatchString(accountName) &&
+		passwordRegexp.MatchString(password)
 }
 
 func digest(src string) string {
@@ -177,6 +180,7 @@ func calculateSalt(accountName string) string {
 	return digest(accountName)
 }
 
+// calculatePasshash は以前の形式のハッシュを計算する。新しく保存するときは hashPassword を使う
 func calculatePasshash(accountName, password string) string {
 	return digest(password + ":" + calculateSalt(accountName))
 }
@@ -193,11 +197,15 @@ func getSessionUser(r *http.Request) User {
 	if !ok || uid == nil {
 		return User{}
 	}
+	sid, _ := session.Values["sid"].(string)
+	if !isSessionActive(sid, uid.(int)) {
+		return User{}
+	}
 
 	u := User{}
 
 	if u, ok := userCache.Get(strconv.Itoa(uid.(int))); ok {
-		return u
+		return activeSessionUser(u)
 	}
 
 	err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", uid)
@@ -206,9 +214,35 @@ func getSessionUser(r *http.Request) User {
 	}
 	userCache.Set(strconv.Itoa(u.ID), u)
 
+	return activeSessionUser(u)
+}
+
+// activeSessionUser は退会したユーザーやBANされたユーザーのセッションをログインしていない扱いにする
+func activeSessionUser(u User) User {
+	if !u.isActive(time.Now()) {
+		return User{}
+	}
 	return u
 }
 
+// startSession はログインしたユーザーのセッションを作って記録し、CSRFトークンを返す
+func startSession(w http.ResponseWriter, r *http.Request, u User) (string, error) {
+	sid, err := registerSession(r, u)
+	if err != nil {
+		return "", err
+	}
+	csrfToken := secureRandomStr(16)
+
+	session := getSession(r)
+	session.Values["user_id"] = u.ID
+	session.Values["sid"] = sid
+	session.Values["csrf_token"] = csrfToken
+	session.Save(r, w)
+
+	userCache.Set(strconv.Itoa(u.ID), u)
+	return csrfToken, nil
+}
+
 func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 	session := getSession(r)
 	value, ok := session.Values[key]
@@ -223,30 +257,33 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 }
 
 func makePosts(results []Post, csrfToken string) ([]Post, error) {
-	postMap := make(map[int]Post, postsPerPage)
+	posts := make([]Post, 0, postsPerPage)
+	index := make(map[int]int, postsPerPage)
 
 	for _, p := range results {
-		if _, ok := postMap[p.ID]; !ok {
-			postMap[p.ID] = p
+		i, ok := index[p.ID]
+		if !ok {
+			p.CSRFToken = csrfToken
+			posts = append(posts, p)
+			i = len(posts) - 1
+			index[p.ID] = i
 		}
 
 		if p.Comment.ID.Valid {
-			p.Comments = append(p.Comments, Comment{
+			posts[i].Comments = append(posts[i].Comments, Comment{
+				ID:         int(p.Comment.ID.Int64),
 				Comment:    p.Comment.Comment.String,
 				AuthorName: p.Comment.User.AccountName.String,
 			})
 		}
 	}
 
-	posts := make([]Post, 0, len(postMap))
-	for _, p := range postMap {
-		p.CSRFToken = csrfToken
-		posts = append(posts, p)
-	}
-
-	slices.SortFunc(posts, func(i Post, j Post) int {
+	slices.SortStableFunc(posts, func(i Post, j Post) int {
 		// 降順
-		return int(j.CreatedAt.UnixNano() - i.CreatedAt.UnixNano())
+		if c := j.CreatedAt.Compare(i.CreatedAt); c != 0 {
+			return c
+		}
+		return j.ID - i.ID
 	})
 
 	return posts, nil
@@ -265,6 +302,10 @@ func imageURL(p Post) string {
 	return "/image/" + strconv.Itoa(p.ID) + ext
 }
 
+func userURL(accountName string) string {
+	return "/@" + url.PathEscape(accountName)
+}
+
 func isLogin(u User) bool {
 	return u.ID != 0
 }
@@ -296,13 +337,22 @@ var (
 
 func getInitialize(w http.ResponseWriter, r *http.Request) {
 	dbInitialize()
-	deleteImageFiles()
-	userCache.Clear()
+	// user_roles を消したので ISUCONP_SUPERADMINS の superadmin を付け直す
+	if err := bootstrapSuperadmins(); err != nil {
+		log.Print(err)
+	}
+	if err := imageStore.DeleteAfter(10000); err != nil {
+		log.Print(err)
+	}
+	invalidateAllUsers()
+	publishTimelineDirty("initialize")
 	w.WriteHeader(http.StatusOK)
 }
 
 var (
-	loginTemplate = template.Must(template.ParseFiles(
+	loginTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("login.html"),
 	))
@@ -328,17 +378,40 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
+	accountName := r.FormValue("account_name")
+	ip := loginLimit.clientIP(r)
+	if retryAfter, locked := loginLimit.locked(accountName, ip); locked {
+		renderLoginLimited(w, retryAfter)
+		return
+	}
+
+	u := tryLogin(accountName, r.FormValue("password"))
 
 	if u != nil {
-		session := getSession(r)
-		session.Values["user_id"] = u.ID
-		session.Values["csrf_token"] = secureRandomStr(16)
-		session.Save(r, w)
+		enabled, err := isTwoFactorEnabled(u.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if enabled {
+			// 失敗回数は2段階目を終えるまで消さない
+			beginPendingLogin(w, r, *u)
+			http.Redirect(w, r, "/login/2fa", http.StatusFound)
+			return
+		}
 
-		userCache.Set(strconv.Itoa(u.ID), *u)
+		loginLimit.succeeded(accountName)
+		if _, err := startSession(w, r, *u); err != nil {
+			log.Print(err)
+			return
+		}
 		http.Redirect(w, r, "/", http.StatusFound)
 	} else {
+		if retryAfter, locked := loginLimit.failed(accountName, ip); locked {
+			renderLoginLimited(w, retryAfter)
+			return
+		}
+
 		session := getSession(r)
 		session.Values["notice"] = "アカウント名かパスワードが間違っています"
 		session.Save(r, w)
@@ -347,8 +420,20 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// renderLoginLimited は失敗が続いてロックされたことをログイン画面で伝える
+func renderLoginLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	loginTemplate.Execute(w, struct {
+		Me    User
+		Flash string
+	}{User{}, loginLimitedMessage})
+}
+
 var (
-	registerTemplate = template.Must(template.ParseFiles(
+	registerTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("register.html"),
 	))
@@ -384,11 +469,14 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	exists := 0
-	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
-	db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
+	// 他のユーザーが以前使っていたアカウント名も使えない
+	exists, err := isAccountNameTaken(accountName, 0)
+	if err != nil {
+		log.Print(err)
+		return
+	}
 
-	if exists == 1 {
+	if exists {
 		session := getSession(r)
 		session.Values["notice"] = "アカウント名がすでに使われています"
 		session.Save(r, w)
@@ -397,46 +485,58 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	passhash, err := hashPassword(password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
 	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	result, err := db.Exec(query, accountName, passhash)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	session := getSession(r)
 	uid, err := result.LastInsertId()
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	session.Values["user_id"] = int(uid)
-	session.Values["csrf_token"] = secureRandomStr(16)
-	session.Save(r, w)
+	u := User{}
+	if err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", uid); err != nil {
+		log.Print(err)
+		return
+	}
+	if _, err := startSession(w, r, u); err != nil {
+		log.Print(err)
+		return
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func getLogout(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
-	delete(session.Values, "user_id")
-	session.Options = &sessions.Options{MaxAge: -1}
-	session.Save(r, w)
+	endSession(w, r)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 var (
 	indexTemplate = txtemplate.Must(txtemplate.New("layout.html").Funcs(txtemplate.FuncMap{
-		"imageURL": imageURL,
-		"escape":   txtemplate.HTMLEscapeString,
+		"imageURL":    imageURL,
+		"imageSrcset": imageSrcset,
+		"userURL":     userURL,
+		"escape":      txtemplate.HTMLEscapeString,
 	}).ParseFiles(
 		getTemplPath("index/layout.html"),
 	))
 
 	indexContentTemplate = txtemplate.Must(txtemplate.New("index.html").Funcs(txtemplate.FuncMap{
-		"imageURL": imageURL,
-		"escape":   txtemplate.HTMLEscapeString,
+		"imageURL":    imageURL,
+		"imageSrcset": imageSrcset,
+		"userURL":     userURL,
+		"escape":      txtemplate.HTMLEscapeString,
 	}).ParseFiles(
 		getTemplPath("index/index.html"),
 		getTemplPath("index/posts.html"),
@@ -445,65 +545,45 @@ var (
 )
 
 var (
-	indexContent    = ""
-	indexPostsMutex = sync.RWMutex{}
-	lastUpdated     = time.Now()
-	lastTriggered   = time.Now()
+	indexPosts = newIndexCache(loadIndexCacheConfig())
 )
 
+func init() {
+	subscribeTimelineDirty(func(string) {
+		indexPosts.markDirty(time.Now())
+	})
+}
+
 func updateIndexPosts() (string, error) {
-	indexPostsMutex.RLock()
-	if lastUpdated.After(lastTriggered) {
-		defer indexPostsMutex.RUnlock()
-		return indexContent, nil
+	if content, ok := indexPosts.get(time.Now()); ok {
+		return content, nil
 	}
-	indexPostsMutex.RUnlock()
-
-	_, err, _ := sf.Do("indexPosts", func() (interface{}, error) {
-		indexPostsMutex.Lock()
-		lastTriggered = time.Now()
-		defer indexPostsMutex.Unlock()
-		results := []Post{}
-		err := db.Select(&results, "WITH pu AS ( SELECT "+
-			"`posts`.`id`, `posts`.`user_id`, `posts`.`body`, `posts`.`mime`, `posts`.`created_at`, "+
-			"`users`.`id` AS `user.id`, `users`.`account_name` AS `user.account_name`, `users`.`authority` AS `user.authority`, `users`.`del_flg` AS `user.del_flg`, `users`.`created_at` AS `user.created_at` "+
-			"FROM `posts` LEFT JOIN `users` ON `users`.`id` = `posts`.`user_id` WHERE `users`.`del_flg` = 0 ORDER BY `posts`.`created_at` DESC LIMIT ? ), "+
-			"pc AS ( SELECT "+
-			"pu.*, "+
-			"`comments`.`id` AS `comment.id`, `comments`.`user_id` AS `comment.user_id`, `comments`.`comment` AS `comment.comment`, `comments`.`created_at` AS `comment.created_at`, "+
-			"`users`.`id` AS `comment.user.id`, `users`.`account_name` AS `comment.user.account_name`, `users`.`authority` AS `comment.user.authority`, `users`.`del_flg` AS `comment.user.del_flg`, `users`.`created_at` AS `comment.user.created_at`, "+
-			"ROW_NUMBER() OVER (PARTITION BY pu.id ORDER BY comments.created_at) AS rn, COUNT(*) OVER (PARTITION BY pu.id) AS comment_count "+
-			"FROM pu "+
-			"LEFT JOIN `comments` ON `comments`.`post_id` = `pu`.`id` "+
-			"LEFT JOIN `users` ON `users`.`id` = `comments`.`user_id` "+
-			"ORDER BY `comments`.`created_at` ) "+
-			"SELECT * FROM pc WHERE (rn <= 3 OR rn IS NULL)", postsPerPage)
+
+	v, err, _ := sf.Do("indexPosts", func() (interface{}, error) {
+		gen := indexPosts.generation()
+		posts, err := selectTimeline(timelineQuery{
+			CommentsPerPost: commentsPerPost,
+			Limit:           postsPerPage,
+		}, "")
 		if err != nil {
 			log.Print(err)
 			return nil, err
 		}
-		posts, err := makePosts(results, "")
-		if err != nil {
-			return nil, err
-		}
 
 		indexContentBuf := bytes.NewBuffer(nil)
 		indexContentTemplate.ExecuteTemplate(indexContentBuf, "index.html", struct {
-			Posts []Post
-		}{posts})
+			Posts      []Post
+			NextCursor string
+		}{posts, nextTimelineCursor(posts, postsPerPage)})
 
-		indexContent = indexContentBuf.String()
-		lastUpdated = time.Now()
-		return nil, nil
+		indexContent := indexContentBuf.String()
+		indexPosts.set(indexContent, gen)
+		return indexContent, nil
 	})
-
-	indexPostsMutex.RLock()
-	defer indexPostsMutex.RUnlock()
-
 	if err != nil {
 		return "", err
 	}
-	return indexContent, nil
+	return v.(string), nil
 }
 
 func getIndex(w http.ResponseWriter, r *http.Request) {
@@ -530,75 +610,105 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 
 var (
 	userTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
-		"imageURL": imageURL,
+		"imageURL":    imageURL,
+		"imageSrcset": imageSrcset,
+		"userURL":     userURL,
 	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("user.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
+		getTemplPath("comments.html"),
+	))
+
+	userNotFoundTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("user_not_found.html"),
 	))
 )
 
-func getAccountName(w http.ResponseWriter, r *http.Request) {
-	accountName := chi.URLParam(r, "accountName")
+// getActiveUser はBANされていないユーザーを返す。見つからなければ sql.ErrNoRows を返す
+func getActiveUser(accountName string) (User, error) {
 	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND "+activeUserCondition, accountName)
+	return user, err
+}
 
-	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-
-	if user.ID == 0 {
+func getAccountName(w http.ResponseWriter, r *http.Request) {
+	accountName := chi.URLParam(r, "accountName")
+	user, err := getActiveUser(accountName)
+	if err == sql.ErrNoRows {
+		if redirectRenamedUser(w, r, accountName, userURL) {
+			return
+		}
+		// 存在しないユーザーとBANされたユーザーは区別しない
 		w.WriteHeader(http.StatusNotFound)
+		userNotFoundTemplate.Execute(w, struct {
+			AccountName string
+			Me          User
+		}{accountName, getSessionUser(r)})
 		return
 	}
-
-	results := []Post{}
-
-	err = db.Select(&results, "WITH pu AS ( SELECT "+
-		"`posts`.`id`, `posts`.`user_id`, `posts`.`body`, `posts`.`mime`, `posts`.`created_at`, "+
-		"`users`.`id` AS `user.id`, `users`.`account_name` AS `user.account_name`, `users`.`authority` AS `user.authority`, `users`.`del_flg` AS `user.del_flg`, `users`.`created_at` AS `user.created_at` "+
-		"FROM `posts` LEFT JOIN `users` ON `users`.`id` = `posts`.`user_id` WHERE `users`.`del_flg` = 0 AND `posts`.`user_id` = ? ORDER BY `posts`.`created_at` DESC LIMIT ? ), "+
-		"pc AS ( SELECT "+
-		"pu.*, "+
-		"`comments`.`id` AS `comment.id`, `comments`.`user_id` AS `comment.user_id`, `comments`.`comment` AS `comment.comment`, `comments`.`created_at` AS `comment.created_at`, "+
-		"`users`.`id` AS `comment.user.id`, `users`.`account_name` AS `comment.user.account_name`, `users`.`authority` AS `comment.user.authority`, `users`.`del_flg` AS `comment.user.del_flg`, `users`.`created_at` AS `comment.user.created_at`, "+
-		"ROW_NUMBER() OVER (PARTITION BY pu.id ORDER BY comments.created_at) AS rn, COUNT(*) OVER (PARTITION BY pu.id) AS comment_count "+
-		"FROM pu "+
-		"LEFT JOIN `comments` ON `comments`.`post_id` = `pu`.`id` "+
-		"LEFT JOIN `users` ON `users`.`id` = `comments`.`user_id` "+
-		"ORDER BY `comments`.`created_at` ) "+
-		"SELECT * FROM pc WHERE (rn <= 3 OR rn IS NULL)",
-		user.ID, postsPerPage)
 	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r))
+	posts, err := selectTimeline(timelineQuery{
+		UserID:          user.ID,
+		CommentsPerPost: commentsPerPost,
+		Limit:           postsPerPage,
+	}, getCSRFToken(r))
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	commentCount := 0
-	err = db.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
+	stats, err := getUserStats(user.ID)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
+	me := getSessionUser(r)
+
+	userTemplate.Execute(w, struct {
+		Posts          []Post
+		User           User
+		PostCount      int
+		CommentCount   int
+		CommentedCount int
+		NextCursor     string
+		Me             User
+	}{posts, user, stats.PostCount, stats.CommentCount, stats.CommentedCount, nextTimelineCursor(posts, postsPerPage), me})
+}
+
+type userStats struct {
+	PostCount      int
+	CommentCount   int
+	CommentedCount int
+}
+
+// getUserStats はユーザーページに表示する投稿数・コメント数・被コメント数を返す
+func getUserStats(userID int) (userStats, error) {
+	stats := userStats{}
+
+	err := db.Get(&stats.CommentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return stats, err
+	}
+
 	postIDs := []int{}
-	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
+	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", userID)
 	if err != nil {
-		log.Print(err)
-		return
+		return stats, err
 	}
-	postCount := len(postIDs)
+	stats.PostCount = len(postIDs)
 
-	commentedCount := 0
-	if postCount > 0 {
+	if stats.PostCount > 0 {
 		s := []string{}
 		for range postIDs {
 			s = append(s, "?")
@@ -611,32 +721,71 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 			args[i] = v
 		}
 
-		err = db.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
+		err = db.Get(&stats.CommentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
 		if err != nil {
-			log.Print(err)
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// getAccountNamePosts はユーザーページの「もっと見る」で次のページを返す
+func getAccountNamePosts(w http.ResponseWriter, r *http.Request) {
+	accountName := chi.URLParam(r, "accountName")
+	user, err := getActiveUser(accountName)
+	if err == sql.ErrNoRows {
+		if redirectRenamedUser(w, r, accountName, func(name string) string { return userURL(name) + "/posts" }) {
 			return
 		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		return
 	}
 
-	me := getSessionUser(r)
+	q := timelineQuery{
+		UserID:          user.ID,
+		CommentsPerPost: commentsPerPost,
+		Limit:           postsPerPage,
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		q.Before, err = decodeTimelineCursor(cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 
-	userTemplate.Execute(w, struct {
-		Posts          []Post
-		User           User
-		PostCount      int
-		CommentCount   int
-		CommentedCount int
-		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+	posts, err := selectTimeline(q, getCSRFToken(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+
+	if len(posts) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("X-Next-Cursor", nextTimelineCursor(posts, q.Limit))
+	postsTemplate.Execute(w, posts)
 }
 
 var (
 	postsTemplate = template.Must(template.New("posts.html").Funcs(template.FuncMap{
-		"imageURL": imageURL,
+		"imageURL":    imageURL,
+		"imageSrcset": imageSrcset,
+		"userURL":     userURL,
 	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
+		getTemplPath("comments.html"),
 	))
 )
 
@@ -647,40 +796,29 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 		return
 	}
-	maxCreatedAt := m.Get("max_created_at")
-	if maxCreatedAt == "" {
-		return
-	}
-
-	t, err := time.Parse(ISO8601Format, maxCreatedAt)
-	if err != nil {
-		log.Print(err)
-		return
+	q := timelineQuery{
+		CommentsPerPost: commentsPerPost,
+		Limit:           postsPerPage,
 	}
 
-	results := []Post{}
-	err = db.Select(&results, "WITH pu AS ( SELECT "+
-		"`posts`.`id`, `posts`.`user_id`, `posts`.`body`, `posts`.`mime`, `posts`.`created_at`, "+
-		"`users`.`id` AS `user.id`, `users`.`account_name` AS `user.account_name`, `users`.`authority` AS `user.authority`, `users`.`del_flg` AS `user.del_flg`, `users`.`created_at` AS `user.created_at` "+
-		"FROM `posts` LEFT JOIN `users` ON `users`.`id` = `posts`.`user_id` WHERE `users`.`del_flg` = 0 AND `posts`.`created_at` <= ? ORDER BY `posts`.`created_at` DESC LIMIT ? ), "+
-		"pc AS ( SELECT "+
-		"pu.*, "+
-		"`comments`.`id` AS `comment.id`, `comments`.`user_id` AS `comment.user_id`, `comments`.`comment` AS `comment.comment`, `comments`.`created_at` AS `comment.created_at`, "+
-		"`users`.`id` AS `comment.user.id`, `users`.`account_name` AS `comment.user.account_name`, `users`.`authority` AS `comment.user.authority`, `users`.`del_flg` AS `comment.user.del_flg`, `users`.`created_at` AS `comment.user.created_at`, "+
-		"ROW_NUMBER() OVER (PARTITION BY pu.id ORDER BY comments.created_at) AS rn, COUNT(*) OVER (PARTITION BY pu.id) AS comment_count "+
-		"FROM pu "+
-		"LEFT JOIN `comments` ON `comments`.`post_id` = `pu`.`id` "+
-		"LEFT JOIN `users` ON `users`.`id` = `comments`.`user_id` "+
-		"ORDER BY `comments`.`created_at` ) "+
-		"SELECT * FROM pc WHERE (rn <= 3 OR rn IS NULL)",
-		t.Format(ISO8601Format), postsPerPage)
-	if err != nil {
-		log.Print(err)
-		return
+	if cursor := m.Get("cursor"); cursor != "" {
+		q.Before, err = decodeTimelineCursor(cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else if maxCreatedAt := m.Get("max_created_at"); maxCreatedAt != "" {
+		// 以前の「もっと見る」やベンチマーカーが使うパラメータ
+		q.MaxCreatedAt, err = time.Parse(ISO8601Format, maxCreatedAt)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r))
+	posts, err := selectTimeline(q, getCSRFToken(r))
 	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		log.Print(err)
 		return
 	}
@@ -690,16 +828,21 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("X-Next-Cursor", nextTimelineCursor(posts, q.Limit))
 	postsTemplate.Execute(w, posts)
 }
 
 var (
 	postIDTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
 		"imageURL": imageURL,
+		"userURL":  userURL,
+		// 投稿単体ページは元の画像だけを出す
+		"imageSrcset": func(Post) string { return "" },
 	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("post_id.html"),
 		getTemplPath("post.html"),
+		getTemplPath("comments.html"),
 	))
 )
 
@@ -711,28 +854,12 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results := []Post{}
-	err = db.Select(&results, "WITH pu AS ( SELECT "+
-		"`posts`.`id`, `posts`.`user_id`, `posts`.`body`, `posts`.`mime`, `posts`.`created_at`, "+
-		"`users`.`id` AS `user.id`, `users`.`account_name` AS `user.account_name`, `users`.`authority` AS `user.authority`, `users`.`del_flg` AS `user.del_flg`, `users`.`created_at` AS `user.created_at` "+
-		"FROM `posts` LEFT JOIN `users` ON `users`.`id` = `posts`.`user_id` WHERE `users`.`del_flg` = 0 AND `posts`.`id` = ? LIMIT ? ), "+
-		"pc AS ( SELECT "+
-		"pu.*, "+
-		"`comments`.`id` AS `comment.id`, `comments`.`user_id` AS `comment.user_id`, `comments`.`comment` AS `comment.comment`, `comments`.`created_at` AS `comment.created_at`, "+
-		"`users`.`id` AS `comment.user.id`, `users`.`account_name` AS `comment.user.account_name`, `users`.`authority` AS `comment.user.authority`, `users`.`del_flg` AS `comment.user.del_flg`, `users`.`created_at` AS `comment.user.created_at`, "+
-		"ROW_NUMBER() OVER (PARTITION BY pu.id ORDER BY comments.created_at) AS rn, COUNT(*) OVER (PARTITION BY pu.id) AS comment_count "+
-		"FROM pu "+
-		"LEFT JOIN `comments` ON `comments`.`post_id` = `pu`.`id` "+
-		"LEFT JOIN `users` ON `users`.`id` = `comments`.`user_id` "+
-		"ORDER BY `comments`.`created_at` ) "+
-		"SELECT * FROM pc",
-		pid, postsPerPage)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-
-	posts, err := makePosts(results, getCSRFToken(r))
+	// コメントは別にページ単位で取得するので、ここでは投稿とコメント数だけ使う
+	posts, err := selectTimeline(timelineQuery{
+		PostID:          pid,
+		CommentsPerPost: 1,
+		Limit:           1,
+	}, getCSRFToken(r))
 	if err != nil {
 		log.Print(err)
 		return
@@ -744,6 +871,15 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p := posts[0]
+	p.Comments, p.CommentsNextCursor, err = selectComments(commentQuery{
+		PostID: p.ID,
+		Order:  postComments.order,
+		Limit:  postComments.perPage,
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
 
 	me := getSessionUser(r)
 
@@ -753,61 +889,143 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 	}{p, me})
 }
 
+var (
+	commentsTemplate = template.Must(template.New("comments.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("comments.html"),
+	))
+)
+
+// postExists は投稿があり、投稿者がBANされていないかを返す
+func postExists(postID int) (bool, error) {
+	exists := 0
+	err := db.Get(&exists, "SELECT 1 FROM `posts` JOIN `users` ON `users`.`id` = `posts`.`user_id` WHERE `posts`.`id` = ? AND "+activeUserCondition, postID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getPostsIDComments は投稿単体ページのコメントの続きを返す
+func getPostsIDComments(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ok, err := postExists(pid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	q := commentQuery{
+		PostID: pid,
+		Order:  postComments.order,
+		Limit:  postComments.perPage,
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		q.After, err = decodeTimelineCursor(cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	comments, next, err := selectComments(q)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+
+	w.Header().Set("X-Next-Cursor", next)
+	commentsTemplate.Execute(w, comments)
+}
+
 func postIndex(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+	me, tokenAuth, err := getRequestUser(r, tokenScopePost)
+	if tokenAuth && err != nil {
+		writeTokenAuthError(w, err)
+		return
+	}
 	if !isLogin(me) {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !tokenAuth && r.FormValue("csrf_token") != getCSRFToken(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	file, _, err := r.FormFile("file")
 	if err != nil {
 		session := getSession(r)
-		session.Values["notice"] = "画像が必須です"
+		session.Values["notice"] = errImageRequired.Error()
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	mime := ""
-	if file != nil {
-		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-		} else {
-			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
-			session.Save(r, w)
+	pid, err := createPost(me, file, r.FormValue("body"))
+	var verr validationError
+	if errors.As(err, &verr) {
+		session := getSession(r)
+		session.Values["notice"] = verr.Error()
+		session.Save(r, w)
 
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
-
-	filedata, err := io.ReadAll(file)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
+	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
+}
+
+// validationError は入力の誤りで、メッセージをそのまま利用者に表示してよいエラー
+type validationError string
+
+func (e validationError) Error() string {
+	return string(e)
+}
+
+const (
+	errImageRequired   validationError = "画像が必須です"
+	errImageType       validationError = "投稿できる画像形式はjpgとpngとgifだけです"
+	errImageTooLarge   validationError = "ファイルサイズが大きすぎます"
+	errCommentNotFound validationError = "コメントする投稿が見つかりません"
+)
+
+// createPost は画像を保存して投稿を作り、投稿IDを返す
+func createPost(me User, file io.Reader, body string) (int64, error) {
+	filedata, err := io.ReadAll(io.LimitReader(file, UploadLimit+1))
+	if err != nil {
+		return 0, err
+	}
+
 	if len(filedata) > UploadLimit {
-		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
-		session.Save(r, w)
+		return 0, errImageTooLarge
+	}
 
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+	// ファイルのタイプは送られてきた Content-Type ではなく中身で決める
+	mime, err := detectImage(filedata)
+	if err != nil {
+		return 0, err
 	}
 
 	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
@@ -816,27 +1034,24 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		me.ID,
 		mime,
 		[]byte{},
-		r.FormValue("body"),
+		body,
 	)
 	if err != nil {
-		log.Print(err)
-		return
+		return 0, err
 	}
 
 	pid, err := result.LastInsertId()
 	if err != nil {
-		log.Print(err)
-		return
+		return 0, err
 	}
 
-	filename := fmt.Sprintf("/home/public/image/%d.%s", pid, getExtension(mime))
-	err = os.WriteFile(filename, filedata, 0644)
+	err = imageStore.Put(imageName(pid, mime), filedata, mime)
 	if err != nil {
-		log.Print("Could not write file: ", err)
-		return
+		return 0, fmt.Errorf("could not store image: %w", err)
 	}
+	publishTimelineDirty("post")
 
-	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
+	return pid, nil
 }
 
 func getExtension(mime string) string {
@@ -853,13 +1068,17 @@ func getExtension(mime string) string {
 }
 
 func postComment(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+	me, tokenAuth, err := getRequestUser(r, tokenScopeComment)
+	if tokenAuth && err != nil {
+		writeTokenAuthError(w, err)
+		return
+	}
 	if !isLogin(me) {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !tokenAuth && r.FormValue("csrf_token") != getCSRFToken(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
@@ -870,8 +1089,11 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = db.Exec(query, postID, me.ID, r.FormValue("comment"))
+	err = createComment(me, postID, r.FormValue("comment"))
+	if errors.Is(err, errCommentNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Print(err)
 		return
@@ -880,67 +1102,175 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
 }
 
+func createComment(me User, postID int, comment string) error {
+	ok, err := postExists(postID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errCommentNotFound
+	}
+
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
+	_, err = db.Exec(query, postID, me.ID, comment)
+	if err != nil {
+		return err
+	}
+	publishTimelineDirty("comment")
+	return nil
+}
+
 var (
-	adminBannedTemplate = template.Must(template.ParseFiles(
+	adminBannedTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
 		getTemplPath("layout.html"),
-		getTemplPath("banned.html")),
-	)
+		getTemplPath("banned.html"),
+	))
 )
 
 func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
+
+	a := parseAdminUserQuery(r.URL.Query())
+	selection := getBanSelection(r)
+	users, hasNext, err := selectAdminUsers(a, selection)
+	if err != nil {
+		log.Print(err)
 		return
 	}
 
-	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
+	bans, err := listActiveBans()
+	if err != nil {
+		log.Print(err)
 		return
 	}
 
-	users := []User{}
-	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	myRole, err := getUserRole(me)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
+	nextPage, prevPage := 0, 0
+	if hasNext {
+		nextPage = a.Page + 1
+	}
+	if a.Page > 1 {
+		prevPage = a.Page - 1
+	}
+
 	adminBannedTemplate.Execute(w, struct {
-		Users     []User
-		Me        User
-		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+		Users          []AdminUser
+		Query          adminUserQuery
+		NextPage       int
+		PrevPage       int
+		SelectedCount  int
+		Bans           []BannedUser
+		Durations      []banDuration
+		CanViewAudit   bool
+		CanManageRoles bool
+		Me             User
+		CSRFToken      string
+	}{users, a, nextPage, prevPage, len(selection), bans, banDurations, myRole.can(permViewAudit), myRole.can(permManageRoles), me, getCSRFToken(r)})
 }
 
 func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Print(err)
 		return
 	}
 
-	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
+	var expiresAt *time.Time
+	if d, err := time.ParseDuration(r.FormValue("duration")); err == nil && d > 0 {
+		t := time.Now().Add(d)
+		expiresAt = &t
+	}
+
+	// 他のページで選んだユーザーもまとめて BANする
+	ids := mergeSelection(getBanSelection(r), r.Form["page_uid[]"], r.Form["uid[]"])
+	banUsers(r, me, ids, r.FormValue("reason"), expiresAt)
+	if err := saveBanSelection(w, r, nil); err != nil {
+		// BANは済んでいるが、選択が残ったままになる
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	a := parseAdminUserQuery(r.Form)
+	http.Redirect(w, r, a.url(a.Page), http.StatusFound)
+}
+
+// banUsers は ids のユーザーを BANし、1人ずつ監査ログに残す。expiresAt が nil なら無期限。
+// BANした人数を返す。管理者や存在しないユーザー、失敗したものは数えない
+func banUsers(r *http.Request, me User, ids []string, reason string, expiresAt *time.Time) int {
+	// bans.reason は varchar(255) なので、文字の途中で切らないように文字数で切る
+	if utf8.RuneCountInString(reason) > 255 {
+		reason = string([]rune(reason)[:255])
+	}
+	detail := "reason=" + reason
+	if expiresAt != nil {
+		detail += " expires_at=" + expiresAt.Format(time.RFC3339)
+	}
+
+	banned := 0
+	for _, id := range ids {
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		target, err := banUser(me.ID, uid, reason, expiresAt)
+		if err != nil {
+			log.Print(err)
+		} else if target.ID != 0 {
+			banned++
+		}
+		recordAudit(r, me, auditActionBan, auditTarget{Type: "user", ID: uid, Name: target.AccountName}, auditOutcome(target.ID != 0, err), detail)
+	}
+	publishTimelineDirty("ban")
+	return banned
+}
+
+// liftBan は BANを解除して監査ログに残す
+func liftBan(r *http.Request, me User, uid int) (bool, error) {
+	target := User{}
+	if err := db.Get(&target, "SELECT * FROM `users` WHERE `id` = ?", uid); err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	lifted, err := unbanUser(me.ID, uid)
+	recordAudit(r, me, auditActionUnban, auditTarget{Type: "user", ID: uid, Name: target.AccountName}, auditOutcome(lifted, err), "")
+	if lifted {
+		publishTimelineDirty("unban")
+	}
+	return lifted, err
+}
+
+func postAdminUnban(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
 	if r.FormValue("csrf_token") != getCSRFToken(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
-
-	err := r.ParseForm()
+	uid, err := strconv.Atoi(r.FormValue("uid"))
 	if err != nil {
-		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
-		userCache.Remove(id)
+	if _, err := liftBan(r, me, uid); err != nil {
+		log.Print(err)
+		return
 	}
 
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
@@ -986,22 +1316,78 @@ func main() {
 	db.SetMaxOpenConns(32)
 	db.SetMaxIdleConns(32)
 
+	imageStore, err = loadImageStore()
+	if err != nil {
+		log.Fatalf("Failed to configure the image store: %s.", err.Error())
+	}
+
+	err = migrateSchema()
+	if err != nil {
+		log.Fatalf("Failed to migrate schema: %s.", err.Error())
+	}
+
+	err = bootstrapSuperadmins()
+	if err != nil {
+		log.Fatalf("Failed to set up superadmins: %s.", err.Error())
+	}
+
+	if report, err := getPasshashReport(); err != nil {
+		log.Print(err)
+	} else {
+		log.Printf("passhash: %d of %d accounts still use the legacy scheme", report.Legacy, report.Total)
+	}
+
+	cacheCoherence.run()
+	runBanSweeper(loadBanSweepInterval())
+	runSessionCheckEvictor()
+
 	r := chi.NewRouter()
 
 	r.Get("/initialize", getInitialize)
 	r.Get("/login", getLogin)
 	r.Post("/login", postLogin)
+	r.Get("/login/2fa", getLoginTwoFactor)
+	r.Post("/login/2fa", postLoginTwoFactor)
 	r.Get("/register", getRegister)
 	r.Post("/register", postRegister)
 	r.Get("/logout", getLogout)
 	r.Get("/", getIndex)
 	r.Get("/posts", getPosts)
 	r.Get("/posts/{id}", getPostsID)
+	r.Get("/posts/{id}/comments", getPostsIDComments)
 	r.Post("/", postIndex)
 	r.Post("/comment", postComment)
-	r.Get("/admin/banned", getAdminBanned)
-	r.Post("/admin/banned", postAdminBanned)
-	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
+	r.Get("/image/{id}.{ext}", getImage)
+	r.Get("/posts/{id}/report", getPostsIDReport)
+	r.Get("/comments/{id}/report", getCommentsIDReport)
+	r.Post("/report", postReport)
+	r.With(requirePermission(permBanUsers)).Get("/admin/banned", getAdminBanned)
+	r.With(requirePermission(permBanUsers)).Post("/admin/banned", postAdminBanned)
+	r.With(requirePermission(permBanUsers)).Post("/admin/banned/select", postAdminBannedSelect)
+	r.With(requirePermission(permBanUsers)).Post("/admin/unban", postAdminUnban)
+	r.With(requirePermission(permViewAudit)).Get("/admin/audit", getAdminAudit)
+	r.With(requirePermission(permViewAudit)).Get("/admin/audit.csv", getAdminAuditCSV)
+	r.With(requirePermission(permManageRoles)).Get("/admin/roles", getAdminRoles)
+	r.With(requirePermission(permManageRoles)).Post("/admin/roles", postAdminRoles)
+	r.With(requirePermission(permRemovePosts)).Get("/admin/reports", getAdminReports)
+	r.With(requirePermission(permRemovePosts)).Post("/admin/reports/resolve", postAdminReportsResolve)
+	r.Get("/tokens", getTokens)
+	r.Post("/tokens", postTokens)
+	r.Post("/tokens/{id}/revoke", postTokensRevoke)
+	r.Get("/settings", getSettings)
+	r.Get("/sessions", getSessions)
+	r.Post("/sessions/{id}/revoke", postSessionsRevoke)
+	r.Post("/sessions/revoke-all", postSessionsRevokeAll)
+	r.Post("/settings/password", postSettingsPassword)
+	r.Post("/settings/account-name", postSettingsAccountName)
+	r.Post("/settings/delete", postSettingsDelete)
+	r.Get("/settings/2fa", getSettingsTwoFactor)
+	r.Post("/settings/2fa/enable", postSettingsTwoFactorEnable)
+	r.Post("/settings/2fa/disable", postSettingsTwoFactorDisable)
+	r.Post("/settings/2fa/recovery-codes", postSettingsTwoFactorRecoveryCodes)
+	r.Get(`/@{accountName:`+accountNamePattern+`}`, getAccountName)
+	r.Get(`/@{accountName:`+accountNamePattern+`}/posts`, getAccountNamePosts)
+	r.Route("/api/v1", apiRoutes)
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
 		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
 	})
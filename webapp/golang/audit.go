@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 管理者の操作の監査ログ。audit_logs には追記だけを行い、更新も削除もしない。
+// 対象のアカウント名は操作した時点のものを残すので、後で名前が変わったり退会したりしても読める。
+
+type auditAction string
+
+const (
+	auditActionBan        auditAction = "ban"
+	auditActionUnban      auditAction = "unban"
+	auditActionRemovePost auditAction = "remove_post"
+	auditActionRoleChange auditAction = "role_change"
+	// 通報から行った操作
+	auditActionRemoveComment auditAction = "remove_comment"
+	auditActionDismissReport auditAction = "dismiss_report"
+
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+	// 対象が見つからない、すでにその状態だったなど、何も変わらなかった
+	auditOutcomeNoop = "noop"
+
+	auditLogsPerPage = 50
+	// CSV で書き出す上限
+	auditLogsExportLimit = 10000
+)
+
+var auditActions = []auditAction{auditActionBan, auditActionUnban, auditActionRemovePost, auditActionRemoveComment, auditActionDismissReport, auditActionRoleChange}
+
+type AuditLog struct {
+	ID               int            `db:"id"`
+	ActorID          int            `db:"actor_id"`
+	ActorAccountName string         `db:"actor_account_name"`
+	Action           auditAction    `db:"action"`
+	TargetType       string         `db:"target_type"`
+	TargetID         sql.NullInt64  `db:"target_id"`
+	TargetName       string         `db:"target_name"`
+	IP               string         `db:"ip"`
+	Outcome          string         `db:"outcome"`
+	Detail           sql.NullString `db:"detail"`
+	CreatedAt        time.Time      `db:"created_at"`
+}
+
+// auditTarget は操作の対象。TargetType は "user"、"post"、"comment" のどれか
+type auditTarget struct {
+	Type string
+	ID   int
+	Name string
+}
+
+func userAuditTarget(u User) auditTarget {
+	return auditTarget{Type: "user", ID: u.ID, Name: u.AccountName}
+}
+
+// recordAudit は監査ログを1件書く。書けなくても操作そのものは止めない
+func recordAudit(r *http.Request, actor User, action auditAction, target auditTarget, outcome, detail string) {
+	ip := ""
+	if addr := loginLimit.clientIP(r); addr != nil {
+		ip = addr.String()
+	}
+	var d sql.NullString
+	if detail != "" {
+		// detail は varchar(1000) なので、文字の途中で切らないように文字数で切る
+		if utf8.RuneCountInString(detail) > 1000 {
+			detail = string([]rune(detail)[:1000])
+		}
+		d = sql.NullString{String: detail, Valid: true}
+	}
+	var targetID sql.NullInt64
+	if target.ID != 0 {
+		targetID = sql.NullInt64{Int64: int64(target.ID), Valid: true}
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO `audit_logs` (`actor_id`, `actor_account_name`, `action`, `target_type`, `target_id`, `target_name`, `ip`, `outcome`, `detail`) VALUES (?,?,?,?,?,?,?,?,?)",
+		actor.ID, actor.AccountName, action, target.Type, targetID, target.Name, ip, outcome, d,
+	)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// auditOutcome は操作の結果を監査ログの outcome にする
+func auditOutcome(changed bool, err error) string {
+	switch {
+	case err != nil:
+		return auditOutcomeFailure
+	case !changed:
+		return auditOutcomeNoop
+	default:
+		return auditOutcomeSuccess
+	}
+}
+
+// auditFilter は /admin/audit の絞り込み条件
+type auditFilter struct {
+	Action  string
+	Actor   string
+	Target  string
+	Outcome string
+	From    string
+	To      string
+	Before  int
+}
+
+func parseAuditFilter(q url.Values) auditFilter {
+	f := auditFilter{
+		Action:  q.Get("action"),
+		Actor:   strings.TrimSpace(q.Get("actor")),
+		Target:  strings.TrimSpace(q.Get("target")),
+		Outcome: q.Get("outcome"),
+		From:    q.Get("from"),
+		To:      q.Get("to"),
+	}
+	f.Before, _ = strconv.Atoi(q.Get("before"))
+	return f
+}
+
+// query は条件に合う監査ログを新しい順に limit 件取る SQL を返す
+func (f auditFilter) query(limit int) (string, []interface{}) {
+	where := []string{}
+	args := []interface{}{}
+
+	if f.Action != "" {
+		where = append(where, "`action` = ?")
+		args = append(args, f.Action)
+	}
+	if f.Actor != "" {
+		where = append(where, "`actor_account_name` = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Target != "" {
+		where = append(where, "`target_name` = ?")
+		args = append(args, f.Target)
+	}
+	if f.Outcome != "" {
+		where = append(where, "`outcome` = ?")
+		args = append(args, f.Outcome)
+	}
+	if t, err := time.ParseInLocation("2006-01-02", f.From, time.Local); err == nil {
+		where = append(where, "`created_at` >= ?")
+		args = append(args, t)
+	}
+	if t, err := time.ParseInLocation("2006-01-02", f.To, time.Local); err == nil {
+		where = append(where, "`created_at` < ?")
+		args = append(args, t.AddDate(0, 0, 1))
+	}
+	if f.Before > 0 {
+		where = append(where, "`id` < ?")
+		args = append(args, f.Before)
+	}
+
+	query := "SELECT * FROM `audit_logs`"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY `id` DESC LIMIT ?"
+	args = append(args, limit)
+	return query, args
+}
+
+// values は次のページへのリンクに使うクエリ文字列を返す
+func (f auditFilter) values() url.Values {
+	v := url.Values{}
+	for k, s := range map[string]string{"action": f.Action, "actor": f.Actor, "target": f.Target, "outcome": f.Outcome, "from": f.From, "to": f.To} {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	return v
+}
+
+func selectAuditLogs(f auditFilter, limit int) ([]AuditLog, error) {
+	logs := []AuditLog{}
+	query, args := f.query(limit)
+	err := db.Select(&logs, query, args...)
+	return logs, err
+}
+
+var (
+	adminAuditTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("audit.html"),
+	))
+)
+
+func getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	f := parseAuditFilter(r.URL.Query())
+	logs, err := selectAuditLogs(f, auditLogsPerPage+1)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	next := ""
+	if len(logs) > auditLogsPerPage {
+		logs = logs[:auditLogsPerPage]
+		v := f.values()
+		v.Set("before", strconv.Itoa(logs[len(logs)-1].ID))
+		next = "/admin/audit?" + v.Encode()
+	}
+	export := "/admin/audit.csv"
+	if v := f.values(); len(v) > 0 {
+		export += "?" + v.Encode()
+	}
+
+	adminAuditTemplate.Execute(w, struct {
+		Me        User
+		Logs      []AuditLog
+		Filter    auditFilter
+		Actions   []auditAction
+		Outcomes  []string
+		NextURL   string
+		ExportURL string
+	}{me, logs, f, auditActions, []string{auditOutcomeSuccess, auditOutcomeFailure, auditOutcomeNoop}, next, export})
+}
+
+func getAdminAuditCSV(w http.ResponseWriter, r *http.Request) {
+	f := parseAuditFilter(r.URL.Query())
+	logs, err := selectAuditLogs(f, auditLogsExportLimit)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-`+time.Now().Format("20060102150405")+`.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "created_at", "actor_id", "actor", "action", "target_type", "target_id", "target", "ip", "outcome", "detail"})
+	for _, l := range logs {
+		targetID := ""
+		if l.TargetID.Valid {
+			targetID = strconv.FormatInt(l.TargetID.Int64, 10)
+		}
+		cw.Write([]string{
+			strconv.Itoa(l.ID),
+			l.CreatedAt.Format(time.RFC3339),
+			strconv.Itoa(l.ActorID),
+			csvSafe(l.ActorAccountName),
+			string(l.Action),
+			l.TargetType,
+			targetID,
+			csvSafe(l.TargetName),
+			l.IP,
+			l.Outcome,
+			csvSafe(l.Detail.String),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Print(err)
+	}
+}
+
+// csvSafe は表計算ソフトで式として解釈されないように先頭の記号を無効にする
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
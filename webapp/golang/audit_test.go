@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuditFilterQuery(t *testing.T) {
+	f := parseAuditFilter(url.Values{
+		"action": {"ban"},
+		"actor":  {" admin "},
+		"from":   {"2024-01-01"},
+		"to":     {"2024-01-31"},
+		"before": {"100"},
+	})
+
+	query, args := f.query(51)
+	for _, s := range []string{"`action` = ?", "`actor_account_name` = ?", "`created_at` >= ?", "`created_at` < ?", "`id` < ?", "ORDER BY `id` DESC LIMIT ?"} {
+		if !strings.Contains(query, s) {
+			t.Errorf("expected query to contain %q: %s", s, query)
+		}
+	}
+	if strings.Contains(query, "`target_name`") {
+		t.Errorf("expected no target condition: %s", query)
+	}
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	want := []interface{}{"ban", "admin", from, from.AddDate(0, 0, 31), 100, 51}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("expected args %v to eq %v", args, want)
+	}
+
+	if v := f.values(); v.Get("before") != "" || v.Get("actor") != "admin" {
+		t.Errorf("unexpected values %v", v)
+	}
+}
+
+func TestCSVSafe(t *testing.T) {
+	for in, want := range map[string]string{"mary": "mary", "=1+1": "'=1+1", "@SUM": "'@SUM", "": ""} {
+		if got := csvSafe(in); got != want {
+			t.Errorf("csvSafe(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRecordAuditCutsDetailByCharacter(t *testing.T) {
+	mock := useMockDB(t)
+
+	// detail は varchar(1000) なので、マルチバイト文字でも1000文字で切る
+	want := sql.NullString{String: strings.Repeat("あ", 1000), Valid: true}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `audit_logs`")).
+		WithArgs(1, "admin", auditActionBan, "user", sql.NullInt64{Int64: 7, Valid: true}, "mary", sqlmock.AnyArg(), auditOutcomeSuccess, want).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r := httptest.NewRequest("POST", "/admin/banned", nil)
+	recordAudit(r, User{ID: 1, AccountName: "admin"}, auditActionBan, auditTarget{Type: "user", ID: 7, Name: "mary"}, auditOutcomeSuccess, strings.Repeat("あ", 1001))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// BAN は bans に理由と実行した管理者と期限を残す。
+// BAN中のユーザーは users.del_flg = 1 で、期限付きなら users.ban_expires_at に期限を持つ。
+// 期限を過ぎたユーザーは activeUserCondition で即座に表示対象に戻り、
+// banSweeper が定期的に del_flg を戻してキャッシュを捨てる。
+// 退会したユーザーも del_flg = 1 だが、有効な BAN が無いので BAN解除の対象にはならない。
+
+// activeUserCondition は BANされていない (期限切れを含む) ユーザーを絞り込む条件
+const activeUserCondition = "(`users`.`del_flg` = 0 OR `users`.`ban_expires_at` <= NOW())"
+
+type banDuration struct {
+	Label    string
+	Duration time.Duration
+}
+
+// banDurations は管理者用ページで選べる期限
+var banDurations = []banDuration{
+	{"無期限", 0},
+	{"1時間", time.Hour},
+	{"1日", 24 * time.Hour},
+	{"7日", 7 * 24 * time.Hour},
+	{"30日", 30 * 24 * time.Hour},
+}
+
+type Ban struct {
+	ID        int           `db:"id"`
+	UserID    int           `db:"user_id"`
+	AdminID   sql.NullInt64 `db:"admin_id"`
+	Reason    string        `db:"reason"`
+	CreatedAt time.Time     `db:"created_at"`
+	ExpiresAt sql.NullTime  `db:"expires_at"`
+	LiftedAt  sql.NullTime  `db:"lifted_at"`
+	LiftedBy  sql.NullInt64 `db:"lifted_by"`
+}
+
+// BannedUser は管理者用ページに出す BAN中のユーザー
+type BannedUser struct {
+	Ban
+	AccountName      string         `db:"account_name"`
+	AdminAccountName sql.NullString `db:"admin_account_name"`
+}
+
+// isActive は BANされていないか、BANの期限が過ぎていれば true を返す
+func (u User) isActive(now time.Time) bool {
+	return u.DelFlg == 0 || (u.BanExpiresAt.Valid && !now.Before(u.BanExpiresAt.Time))
+}
+
+// banUser は一般ユーザーを BANし、BANしたユーザーを返す。expiresAt が nil なら無期限。
+// すでに BAN中なら前の BANを終わらせて置き換える。
+// 管理者と存在しないユーザーは BANせず、ID が 0 のユーザーを返す。
+func banUser(adminID, userID int, reason string, expiresAt *time.Time) (User, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	u := User{}
+	err = tx.Get(&u, "SELECT * FROM `users` WHERE `id` = ? AND `authority` = 0 FOR UPDATE", userID)
+	if err == sql.ErrNoRows {
+		return User{}, nil
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.Exec("UPDATE `users` SET `del_flg` = 1, `ban_expires_at` = ? WHERE `id` = ?", expiresAt, userID)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.Exec("UPDATE `bans` SET `lifted_at` = NOW(), `lifted_by` = ? WHERE `user_id` = ? AND `lifted_at` IS NULL", adminID, userID)
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec("INSERT INTO `bans` (`user_id`, `admin_id`, `reason`, `expires_at`) VALUES (?,?,?,?)", userID, adminID, reason, expiresAt)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, err
+	}
+
+	invalidateUser(strconv.Itoa(userID))
+	// BANされたユーザーはすぐにログアウトさせる
+	return u, revokeUserSessions(userID)
+}
+
+// unbanUser は有効な BANを解除する。解除したら true を返す
+func unbanUser(adminID, userID int) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE `bans` SET `lifted_at` = NOW(), `lifted_by` = ? WHERE `user_id` = ? AND `lifted_at` IS NULL", adminID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE `users` SET `del_flg` = 0, `ban_expires_at` = NULL WHERE `id` = ?", userID)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	invalidateUser(strconv.Itoa(userID))
+	return true, nil
+}
+
+// listActiveBans は解除されておらず期限も過ぎていない BANを新しい順に返す
+func listActiveBans() ([]BannedUser, error) {
+	bans := []BannedUser{}
+	err := db.Select(&bans, "SELECT `bans`.*, `users`.`account_name`, `admins`.`account_name` AS `admin_account_name` FROM `bans` "+
+		"JOIN `users` ON `users`.`id` = `bans`.`user_id` "+
+		"LEFT JOIN `users` AS `admins` ON `admins`.`id` = `bans`.`admin_id` "+
+		"WHERE `bans`.`lifted_at` IS NULL AND (`bans`.`expires_at` IS NULL OR `bans`.`expires_at` > NOW()) "+
+		"ORDER BY `bans`.`created_at` DESC, `bans`.`id` DESC")
+	return bans, err
+}
+
+// liftExpiredBans は期限を過ぎた BANを解除し、解除した人数を返す
+func liftExpiredBans() (int, error) {
+	ids := []int{}
+	err := db.Select(&ids, "SELECT `id` FROM `users` WHERE `del_flg` = 1 AND `ban_expires_at` <= NOW()")
+	if err != nil {
+		return 0, err
+	}
+
+	lifted := 0
+	for _, id := range ids {
+		result, err := db.Exec("UPDATE `users` SET `del_flg` = 0, `ban_expires_at` = NULL WHERE `id` = ? AND `del_flg` = 1 AND `ban_expires_at` <= NOW()", id)
+		if err != nil {
+			return lifted, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			// 他のノードが先に解除した
+			continue
+		}
+		// lifted_by が NULL のものは期限で解除された
+		_, err = db.Exec("UPDATE `bans` SET `lifted_at` = `expires_at` WHERE `user_id` = ? AND `lifted_at` IS NULL AND `expires_at` <= NOW()", id)
+		if err != nil {
+			return lifted, err
+		}
+		invalidateUser(strconv.Itoa(id))
+		lifted++
+	}
+	if lifted > 0 {
+		publishTimelineDirty("unban")
+	}
+	return lifted, nil
+}
+
+func loadBanSweepInterval() time.Duration {
+	s := os.Getenv("ISUCONP_BAN_SWEEP_INTERVAL")
+	if s == "" {
+		return time.Minute
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Printf("invalid ISUCONP_BAN_SWEEP_INTERVAL %q: %s", s, err)
+		return time.Minute
+	}
+	return d
+}
+
+// runBanSweeper は期限切れの BANを定期的に解除する。interval が 0 以下なら動かさない
+func runBanSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := liftExpiredBans(); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+}
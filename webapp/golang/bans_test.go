@@ -0,0 +1,26 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestUserIsActive(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		u    User
+		want bool
+	}{
+		{"active", User{}, true},
+		{"banned", User{DelFlg: 1}, false},
+		{"temporarily banned", User{DelFlg: 1, BanExpiresAt: sql.NullTime{Time: now.Add(time.Minute), Valid: true}}, false},
+		{"ban expired", User{DelFlg: 1, BanExpiresAt: sql.NullTime{Time: now, Valid: true}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.u.isActive(now); got != tt.want {
+			t.Errorf("%s: isActive = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
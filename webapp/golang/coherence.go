@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// 複数台構成のとき、各プロセスが持つキャッシュを揃えるための仕組み。
+// 書き込んだノードが memcached 上の世代番号を進め、各ノードは定期的に
+// 世代番号を読んで変わっていたら手元のキャッシュを捨てる。
+
+const (
+	coherenceTimelineKey = "isuconp_gen_timeline"
+	coherenceUsersKey    = "isuconp_gen_users"
+)
+
+// generationClient は世代番号を置く memcached のクライアント。*memcache.Client が満たす
+type generationClient interface {
+	Increment(key string, delta uint64) (uint64, error)
+	Add(item *memcache.Item) error
+	GetMulti(keys []string) (map[string]*memcache.Item, error)
+}
+
+type coherence struct {
+	client   generationClient
+	interval time.Duration
+
+	mu       sync.Mutex
+	seen     map[string]uint64
+	handlers map[string][]func()
+	failing  bool
+}
+
+func newCoherence(client generationClient, interval time.Duration) *coherence {
+	return &coherence{
+		client:   client,
+		interval: interval,
+		seen:     map[string]uint64{},
+		handlers: map[string][]func(){},
+	}
+}
+
+func loadCoherenceInterval() time.Duration {
+	s := os.Getenv("ISUCONP_COHERENCE_INTERVAL")
+	if s == "" {
+		return 200 * time.Millisecond
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Printf("invalid ISUCONP_COHERENCE_INTERVAL %q: %s", s, err)
+		return 200 * time.Millisecond
+	}
+	return d
+}
+
+// watch は他のノードが key の世代を進めたときに呼ばれる関数を登録する
+func (c *coherence) watch(key string, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[key] = append(c.handlers[key], f)
+}
+
+// bump は key の世代を進める。自分のノードのキャッシュは呼び出し側で消しておくこと。
+func (c *coherence) bump(key string) {
+	if c.interval <= 0 {
+		return
+	}
+
+	v, err := c.client.Increment(key, 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		err = c.client.Add(&memcache.Item{Key: key, Value: []byte("1")})
+		if errors.Is(err, memcache.ErrNotStored) {
+			v, err = c.client.Increment(key, 1)
+		} else if err == nil {
+			v = 1
+		}
+	}
+	if err != nil {
+		log.Printf("coherence: failed to bump %s: %s", key, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 自分の書き込みだけで進んだ場合は poll で二重に捨てないようにする
+	if seen, ok := c.seen[key]; ok && seen+1 == v {
+		c.seen[key] = v
+	}
+}
+
+func (c *coherence) poll() {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.handlers))
+	for k := range c.handlers {
+		keys = append(keys, k)
+	}
+	c.mu.Unlock()
+
+	items, err := c.client.GetMulti(keys)
+	if err != nil {
+		c.mu.Lock()
+		if !c.failing {
+			log.Printf("coherence: failed to read generations: %s", err)
+		}
+		c.failing = true
+		c.mu.Unlock()
+		return
+	}
+
+	fired := []func(){}
+	c.mu.Lock()
+	c.failing = false
+	for _, k := range keys {
+		v := uint64(0)
+		if item, ok := items[k]; ok {
+			v, _ = strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
+		}
+		seen, ok := c.seen[k]
+		c.seen[k] = v
+		// 初回は基準値を覚えるだけ
+		if ok && seen != v {
+			fired = append(fired, c.handlers[k]...)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, f := range fired {
+		f()
+	}
+}
+
+// run はバックグラウンドで世代番号の監視を続ける
+func (c *coherence) run() {
+	if c.interval <= 0 {
+		return
+	}
+
+	c.poll()
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.poll()
+		}
+	}()
+}
+
+// invalidateUser は手元の userCache から id を消し、他のノードにも知らせる
+func invalidateUser(id string) {
+	userCache.Remove(id)
+	cacheCoherence.bump(coherenceUsersKey)
+}
+
+func invalidateAllUsers() {
+	userCache.Clear()
+	cacheCoherence.bump(coherenceUsersKey)
+}
+
+func init() {
+	subscribeTimelineDirty(func(string) {
+		cacheCoherence.bump(coherenceTimelineKey)
+	})
+	cacheCoherence.watch(coherenceTimelineKey, func() {
+		indexPosts.markDirty(time.Now())
+	})
+	cacheCoherence.watch(coherenceUsersKey, func() {
+		userCache.Clear()
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// fakeGenerations は複数のノードで共有する memcached の代わり
+type fakeGenerations struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (f *fakeGenerations) Increment(key string, delta uint64) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[key]
+	if !ok {
+		return 0, memcache.ErrCacheMiss
+	}
+	f.values[key] = v + delta
+	return v + delta, nil
+}
+
+func (f *fakeGenerations) Add(item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.values[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+	v, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return err
+	}
+	f.values[item.Key] = v
+	return nil
+}
+
+func (f *fakeGenerations) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items := map[string]*memcache.Item{}
+	for _, k := range keys {
+		if v, ok := f.values[k]; ok {
+			items[k] = &memcache.Item{Key: k, Value: []byte(strconv.FormatUint(v, 10))}
+		}
+	}
+	return items, nil
+}
+
+func TestCoherenceBumpAndPoll(t *testing.T) {
+	store := &fakeGenerations{values: map[string]uint64{}}
+	a := newCoherence(store, 1)
+	b := newCoherence(store, 1)
+
+	fired := map[string]int{}
+	a.watch("gen", func() { fired["a"]++ })
+	b.watch("gen", func() { fired["b"]++ })
+
+	// 初回は基準値を覚えるだけ
+	a.poll()
+	b.poll()
+	if len(fired) != 0 {
+		t.Fatalf("expected the first poll not to fire, got %v", fired)
+	}
+
+	// 世代番号がまだ無くても作って進める
+	a.bump("gen")
+	if store.values["gen"] != 1 {
+		t.Fatalf("generation = %d, want 1", store.values["gen"])
+	}
+	a.poll()
+	b.poll()
+	if fired["a"] != 0 || fired["b"] != 1 {
+		t.Errorf("expected only the other node to fire, got %v", fired)
+	}
+
+	// 他のノードの書き込みが挟まれば自分も捨てる
+	a.bump("gen")
+	b.bump("gen")
+	a.poll()
+	b.poll()
+	if fired["a"] != 1 || fired["b"] != 2 {
+		t.Errorf("expected both nodes to fire, got %v", fired)
+	}
+
+	a.poll()
+	b.poll()
+	if fired["a"] != 1 || fired["b"] != 2 {
+		t.Errorf("expected an unchanged generation not to fire, got %v", fired)
+	}
+}
+
+func TestCoherenceDisabled(t *testing.T) {
+	store := &fakeGenerations{values: map[string]uint64{}}
+	c := newCoherence(store, 0)
+	c.bump("gen")
+	if _, ok := store.values["gen"]; ok {
+		t.Error("expected bump to do nothing when the interval is 0")
+	}
+}
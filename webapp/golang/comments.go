@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 投稿単体ページのコメントの並び順
+type commentOrder int
+
+const (
+	commentsOldestFirst commentOrder = iota
+	commentsNewestFirst
+)
+
+type postCommentsConfig struct {
+	order   commentOrder
+	perPage int
+}
+
+var postComments = loadPostCommentsConfig()
+
+func loadPostCommentsConfig() postCommentsConfig {
+	c := postCommentsConfig{
+		order:   commentsOldestFirst,
+		perPage: 20,
+	}
+
+	switch o := os.Getenv("ISUCONP_POST_COMMENTS_ORDER"); o {
+	case "", "oldest":
+	case "newest":
+		c.order = commentsNewestFirst
+	default:
+		log.Printf("unknown ISUCONP_POST_COMMENTS_ORDER %q, falling back to oldest", o)
+	}
+
+	if s := os.Getenv("ISUCONP_POST_COMMENTS_PER_PAGE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			log.Printf("invalid ISUCONP_POST_COMMENTS_PER_PAGE %q", s)
+		} else {
+			c.perPage = n
+		}
+	}
+
+	return c
+}
+
+// commentQuery は投稿単体ページで1ページ分のコメントを取得するときの条件
+type commentQuery struct {
+	PostID int
+	Order  commentOrder
+	// nil のときは先頭から。前のページの最後のコメントを指す
+	After *timelineCursor
+	Limit int
+}
+
+type commentRow struct {
+	ID          int       `db:"id"`
+	Comment     string    `db:"comment"`
+	CreatedAt   time.Time `db:"created_at"`
+	AccountName string    `db:"account_name"`
+}
+
+// build は次のページがあるか判定するため Limit より1件多く取得する SQL を返す
+func (q commentQuery) build() (string, []interface{}) {
+	query := "SELECT `comments`.`id`, `comments`.`comment`, `comments`.`created_at`, `users`.`account_name` " +
+		"FROM `comments` JOIN `users` ON `users`.`id` = `comments`.`user_id` " +
+		"WHERE `comments`.`post_id` = ? "
+	args := []interface{}{q.PostID}
+
+	cmp, dir := ">", "ASC"
+	if q.Order == commentsNewestFirst {
+		cmp, dir = "<", "DESC"
+	}
+
+	if q.After != nil {
+		query += "AND (`comments`.`created_at` " + cmp + " ? OR (`comments`.`created_at` = ? AND `comments`.`id` " + cmp + " ?)) "
+		args = append(args, q.After.CreatedAt, q.After.CreatedAt, q.After.ID)
+	}
+
+	query += "ORDER BY `comments`.`created_at` " + dir + ", `comments`.`id` " + dir + " LIMIT ?"
+	args = append(args, q.Limit+1)
+
+	return query, args
+}
+
+// selectComments は1ページ分のコメントと次のページのカーソルを返す。
+// 次のページがなければカーソルは空文字になる。
+func selectComments(q commentQuery) ([]Comment, string, error) {
+	query, args := q.build()
+
+	rows := []commentRow{}
+	err := db.Select(&rows, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+		last := rows[len(rows)-1]
+		next = (&timelineCursor{CreatedAt: last.CreatedAt, ID: last.ID}).Encode()
+	}
+
+	comments := make([]Comment, 0, len(rows))
+	for _, row := range rows {
+		comments = append(comments, Comment{
+			ID:         row.ID,
+			Comment:    row.Comment,
+			AuthorName: row.AccountName,
+		})
+	}
+
+	return comments, next, nil
+}
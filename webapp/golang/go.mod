@@ -3,17 +3,19 @@ module github.com/catatsuy/private-isu/webapp/golang
 go 1.19
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.0
 	github.com/bradfitz/gomemcache v0.0.0-20230905024940-24af94b03874
 	github.com/bradleypeabody/gorilla-sessions-memcache v0.0.0-20181103040241-659414f458e1
 	github.com/go-chi/chi/v5 v5.0.10
 	github.com/go-sql-driver/mysql v1.7.1
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/jmoiron/sqlx v1.3.5
+	github.com/orcaman/concurrent-map/v2 v2.0.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.14.0
+	golang.org/x/image v0.13.0
+	golang.org/x/sync v0.3.0
 )
 
-require (
-	github.com/gorilla/securecookie v1.1.1 // indirect
-	github.com/memcachier/mc v2.0.1+incompatible // indirect
-	github.com/orcaman/concurrent-map/v2 v2.0.1 // indirect
-	golang.org/x/sync v0.3.0 // indirect
-)
+require github.com/memcachier/mc v2.0.1+incompatible // indirect
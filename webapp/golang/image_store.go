@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 投稿画像の保存先。ISUCONP_IMAGE_STORE で選ぶ。
+//   local (既定): ISUCONP_IMAGE_DIR (既定は /home/public/image) にファイルとして置く
+//   db: posts.imgdata に置く
+//   s3: S3 互換のオブジェクトストレージに置く (設定は loadS3ImageStore を参照)
+// 画像は "{投稿ID}.{拡張子}"、縮小画像は "{投稿ID}_{幅}.{拡張子}" の名前で保存する。
+
+// ImageStore は投稿画像を保存・取得・削除する
+type ImageStore interface {
+	// Put は name で画像を保存する。同じ名前があれば上書きする
+	Put(name string, data []byte, mime string) error
+	// Get は name の画像を返す。無ければ fs.ErrNotExist を返す
+	Get(name string) (*storedImage, error)
+	// Delete は name の画像を消す。無くてもエラーにしない
+	Delete(name string) error
+	// DeleteAfter は投稿IDが maxPostID より大きい画像をすべて消す。/initialize で使う
+	DeleteAfter(maxPostID int) error
+}
+
+// storedImage は保存先から読み出した画像。使い終わったら Close する
+type storedImage struct {
+	io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func newStoredImage(data []byte, modTime time.Time) *storedImage {
+	return &storedImage{
+		ReadSeekCloser: nopSeekCloser{bytes.NewReader(data)},
+		Size:           int64(len(data)),
+		ModTime:        modTime,
+	}
+}
+
+// imageName は投稿の画像を保存する名前を返す
+func imageName(pid int64, mime string) string {
+	return fmt.Sprintf("%d.%s", pid, getExtension(mime))
+}
+
+// imageNamePostID は画像の名前から投稿IDを取り出す
+func imageNamePostID(name string) (int, bool) {
+	id, _, ok := parseImageName(name)
+	return id, ok
+}
+
+func loadImageStore() (ImageStore, error) {
+	switch kind := os.Getenv("ISUCONP_IMAGE_STORE"); kind {
+	case "", "local":
+		dir := os.Getenv("ISUCONP_IMAGE_DIR")
+		if dir == "" {
+			dir = "/home/public/image"
+		}
+		return &localImageStore{dir: dir}, nil
+	case "db":
+		return dbImageStore{}, nil
+	case "s3":
+		return loadS3ImageStore()
+	default:
+		return nil, fmt.Errorf("unknown ISUCONP_IMAGE_STORE %q", kind)
+	}
+}
+
+// localImageStore はディレクトリにファイルとして置く
+type localImageStore struct {
+	dir string
+}
+
+func (s *localImageStore) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fs.ErrNotExist
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *localImageStore) Put(name string, data []byte, mime string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	// 書きかけのファイルを配信しないように、別名で書いてから置き換える
+	f, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *localImageStore) Get(name string) (*storedImage, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &storedImage{ReadSeekCloser: f, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localImageStore) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localImageStore) DeleteAfter(maxPostID int) error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		id, ok := imageNamePostID(file.Name())
+		if !ok || id <= maxPostID {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, file.Name())); err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// dbImageStore は posts.imgdata に置く。投稿の行が無ければ保存できない。
+// 縮小画像は image_variants に置く。
+type dbImageStore struct{}
+
+func (dbImageStore) Put(name string, data []byte, mime string) error {
+	id, width, ok := parseImageName(name)
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if width > 0 {
+		_, err := db.Exec("INSERT INTO `image_variants` (`name`, `post_id`, `data`) VALUES (?,?,?) ON DUPLICATE KEY UPDATE `data` = VALUES(`data`)", name, id, data)
+		return err
+	}
+	result, err := db.Exec("UPDATE `posts` SET `imgdata` = ? WHERE `id` = ?", data, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 同じ内容で上書きしたときも 0 になるので、行があるかを確かめる
+		ok, err := postRowExists(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fs.ErrNotExist
+		}
+	}
+	return nil
+}
+
+func (dbImageStore) Get(name string) (*storedImage, error) {
+	id, width, ok := parseImageName(name)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	row := struct {
+		Imgdata   []byte    `db:"imgdata"`
+		CreatedAt time.Time `db:"created_at"`
+	}{}
+	var err error
+	if width > 0 {
+		err = db.Get(&row, "SELECT `data` AS `imgdata`, `created_at` FROM `image_variants` WHERE `name` = ?", name)
+	} else {
+		err = db.Get(&row, "SELECT `imgdata`, `created_at` FROM `posts` WHERE `id` = ?", id)
+	}
+	if err == sql.ErrNoRows || (err == nil && len(row.Imgdata) == 0) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newStoredImage(row.Imgdata, row.CreatedAt), nil
+}
+
+func (dbImageStore) Delete(name string) error {
+	id, width, ok := parseImageName(name)
+	if !ok {
+		return nil
+	}
+	if width > 0 {
+		_, err := db.Exec("DELETE FROM `image_variants` WHERE `name` = ?", name)
+		return err
+	}
+	_, err := db.Exec("UPDATE `posts` SET `imgdata` = '' WHERE `id` = ?", id)
+	return err
+}
+
+// DeleteAfter は縮小画像だけを消す。元の画像は投稿の行と一緒に消える
+func (dbImageStore) DeleteAfter(maxPostID int) error {
+	_, err := db.Exec("DELETE FROM `image_variants` WHERE `post_id` > ?", maxPostID)
+	return err
+}
+
+func postRowExists(id int) (bool, error) {
+	exists := 0
+	err := db.Get(&exists, "SELECT 1 FROM `posts` WHERE `id` = ?", id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
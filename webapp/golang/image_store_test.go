@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageNamePostID(t *testing.T) {
+	tests := map[string]int{"1.jpg": 1, "10001.png": 10001, "10001_320.png": 10001, "1_x.jpg": 0, "x.jpg": 0, "0.gif": 0, "12": 0, ".upload-1": 0}
+	for name, want := range tests {
+		got, ok := imageNamePostID(name)
+		if got != want || ok != (want != 0) {
+			t.Errorf("imageNamePostID(%q) = %d, %v", name, got, ok)
+		}
+	}
+}
+
+func TestLocalImageStore(t *testing.T) {
+	dir := t.TempDir()
+	s := &localImageStore{dir: dir}
+
+	for _, name := range []string{"1.jpg", "10001.png", "10001_320.png"} {
+		if err := s.Put(name, []byte(name), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put("../escape.jpg", []byte("x"), "image/jpeg"); err == nil {
+		t.Error("expected a name outside the directory to be rejected")
+	}
+
+	img, err := s.Get("1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(img)
+	img.Close()
+	if string(b) != "1.jpg" || img.Size != 5 {
+		t.Errorf("unexpected image %q size=%d", b, img.Size)
+	}
+
+	if err := s.DeleteAfter(10000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("10001.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+	if err := s.Delete("1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected %s to be empty, got %v", filepath.Base(dir), files)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// 投稿画像の形式はクライアントの Content-Type ではなく、中身の先頭のバイト列で決める。
+// そのうえで全体をデコードして壊れていないことを確かめ、画像の終わりより後ろにデータが続くもの
+// (画像と別の形式のファイルを繋げたもの) も受け付けない。
+
+const (
+	// 幅と高さの上限
+	maxImageDimension = 10000
+	// 画素数の上限。デコードにかかるメモリを抑える
+	maxImagePixels = 50_000_000
+)
+
+const (
+	errImageBroken       validationError = "画像が壊れているか、途中で切れています"
+	errImageTrailingData validationError = "画像の後ろに余分なデータが含まれています"
+	errImageDimensions   validationError = "画像が大きすぎます。幅と高さは10000ピクセル以内にしてください"
+)
+
+var errImageStructure = errors.New("malformed image structure")
+
+// sniffImageMime は先頭のバイト列から画像の形式を返す。対応していなければ空文字列
+func sniffImageMime(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	}
+	return ""
+}
+
+// detectImage は投稿された画像を確かめて、保存する形式を返す
+func detectImage(data []byte) (string, error) {
+	mime := sniffImageMime(data)
+	if mime == "" {
+		return "", errImageType
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || "image/"+format != mime {
+		return "", errImageBroken
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return "", errImageBroken
+	}
+	if config.Width > maxImageDimension || config.Height > maxImageDimension || config.Width*config.Height > maxImagePixels {
+		return "", errImageDimensions
+	}
+
+	// 途中で切れたものはデコードできない
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return "", errImageBroken
+	}
+
+	end, err := imageEnd(mime, data)
+	if err != nil {
+		return "", errImageBroken
+	}
+	// 0 で埋めただけのものは許す
+	if len(bytes.Trim(data[end:], "\x00")) > 0 {
+		return "", errImageTrailingData
+	}
+	return mime, nil
+}
+
+// imageEnd は画像の構造をたどって、画像の終わりの位置を返す
+func imageEnd(mime string, data []byte) (int, error) {
+	switch mime {
+	case "image/jpeg":
+		return jpegEnd(data)
+	case "image/png":
+		return pngEnd(data)
+	case "image/gif":
+		return gifEnd(data)
+	}
+	return 0, errImageStructure
+}
+
+// jpegEnd は EOI マーカーの直後の位置を返す
+func jpegEnd(data []byte) (int, error) {
+	i := 2
+	for i+1 < len(data) {
+		if data[i] != 0xff {
+			return 0, errImageStructure
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// マーカーの前の埋め草
+			i++
+			continue
+		case marker == 0xd9:
+			return i + 2, nil
+		case marker == 0x01 || (0xd0 <= marker && marker <= 0xd7):
+			// 長さを持たないマーカー
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return 0, errImageStructure
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 {
+			return 0, errImageStructure
+		}
+		i += 2 + length
+		if marker != 0xda {
+			continue
+		}
+
+		// SOS の後ろの圧縮データは、RST と 0xff00 以外の 0xff で終わる
+		for i+1 < len(data) {
+			if data[i] == 0xff && data[i+1] != 0x00 && !(0xd0 <= data[i+1] && data[i+1] <= 0xd7) {
+				break
+			}
+			i++
+		}
+	}
+	return 0, errImageStructure
+}
+
+// pngEnd は IEND チャンクの直後の位置を返す
+func pngEnd(data []byte) (int, error) {
+	i := 8
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length > len(data)-i-12 {
+			return 0, errImageStructure
+		}
+		chunkType := string(data[i+4 : i+8])
+		i += 12 + length
+		if chunkType == "IEND" {
+			return i, nil
+		}
+	}
+	return 0, errImageStructure
+}
+
+// gifEnd は Trailer の直後の位置を返す
+func gifEnd(data []byte) (int, error) {
+	if len(data) < 13 {
+		return 0, errImageStructure
+	}
+	i := 13
+	// グローバルカラーテーブル
+	if data[10]&0x80 != 0 {
+		i += 3 << (int(data[10]&0x07) + 1)
+	}
+
+	// サブブロックの並びを飛ばす
+	skipSubBlocks := func() bool {
+		for i < len(data) {
+			size := int(data[i])
+			i += 1 + size
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i < len(data) {
+		switch data[i] {
+		case 0x3b:
+			return i + 1, nil
+		case 0x21:
+			// 拡張ブロック
+			i += 2
+			if !skipSubBlocks() {
+				return 0, errImageStructure
+			}
+		case 0x2c:
+			// イメージ記述子
+			if i+10 > len(data) {
+				return 0, errImageStructure
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (int(flags&0x07) + 1)
+			}
+			// LZW の最小コードサイズ
+			i++
+			if !skipSubBlocks() {
+				return 0, errImageStructure
+			}
+		default:
+			return 0, errImageStructure
+		}
+	}
+	return 0, errImageStructure
+}
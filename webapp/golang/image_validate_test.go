@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+)
+
+func encodeTestImage(t *testing.T, mime string, w, h int) []byte {
+	t.Helper()
+	img := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White})
+	for x := 0; x < w; x++ {
+		img.SetColorIndex(x, x%h, 1)
+	}
+
+	buf := bytes.Buffer{}
+	var err error
+	switch mime {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "image/png":
+		err = png.Encode(&buf, img)
+	case "image/gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectImage(t *testing.T) {
+	for _, mime := range []string{"image/jpeg", "image/png", "image/gif"} {
+		t.Run(mime, func(t *testing.T) {
+			data := encodeTestImage(t, mime, 64, 48)
+
+			if got, err := detectImage(data); err != nil || got != mime {
+				t.Errorf("detectImage = %q, %v, want %q", got, err, mime)
+			}
+			if _, err := detectImage(data[:len(data)-len(data)/3]); err != errImageBroken {
+				t.Errorf("expected truncated image to be rejected with errImageBroken, got %v", err)
+			}
+			if _, err := detectImage(append(bytes.Clone(data), "PK\x03\x04polyglot"...)); err != errImageTrailingData {
+				t.Errorf("expected trailing data to be rejected, got %v", err)
+			}
+			if _, err := detectImage(append(bytes.Clone(data), 0, 0, 0)); err != nil {
+				t.Errorf("expected zero padding to be accepted, got %v", err)
+			}
+		})
+	}
+
+	if _, err := detectImage([]byte("<html><script>alert(1)</script></html>")); err != errImageType {
+		t.Errorf("expected errImageType, got %v", err)
+	}
+	if _, err := detectImage(encodeTestImage(t, "image/png", maxImageDimension+1, 1)); err != errImageDimensions {
+		t.Errorf("expected errImageDimensions, got %v", err)
+	}
+
+	loader, err := os.ReadFile("../public/img/ajax-loader.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := detectImage(loader); err != nil || got != "image/gif" {
+		t.Errorf("detectImage(ajax-loader.gif) = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// 一覧に出す縮小画像。最初にリクエストされたときに元の画像から作り、元の画像と同じ保存先に
+// "{投稿ID}_{幅}.{拡張子}" の名前で置く。一覧の img には srcset で縮小画像を並べ、
+// src は元の画像のままにする。投稿単体ページは元の画像だけを出す。
+// GIF はアニメーションを崩さないように縮小しない。
+
+// imageVariantWidths は縮小画像の幅
+var imageVariantWidths = []int{320, 640, 1280}
+
+const imageVariantJPEGQuality = 85
+
+func hasImageVariants(mime string) bool {
+	return mime == "image/jpeg" || mime == "image/png"
+}
+
+func isImageVariantWidth(width int) bool {
+	for _, w := range imageVariantWidths {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+// imageVariantName は縮小画像を保存する名前を返す
+func imageVariantName(pid int64, mime string, width int) string {
+	return fmt.Sprintf("%d_%d.%s", pid, width, getExtension(mime))
+}
+
+// parseImageName は画像の名前から投稿IDと、縮小画像なら幅を取り出す
+func parseImageName(name string) (pid int, width int, ok bool) {
+	base, _, ok := strings.Cut(name, ".")
+	if !ok {
+		return 0, 0, false
+	}
+	id, w, hasWidth := strings.Cut(base, "_")
+	pid, err := strconv.Atoi(id)
+	if err != nil || pid <= 0 {
+		return 0, 0, false
+	}
+	if hasWidth {
+		width, err = strconv.Atoi(w)
+		if err != nil || width <= 0 {
+			return 0, 0, false
+		}
+	}
+	return pid, width, true
+}
+
+// imageSrcset は一覧の img に付ける srcset を返す。縮小しない形式なら空文字列
+func imageSrcset(p Post) string {
+	if !hasImageVariants(p.Mime) {
+		return ""
+	}
+	candidates := make([]string, 0, len(imageVariantWidths))
+	for _, w := range imageVariantWidths {
+		candidates = append(candidates, fmt.Sprintf("/image/%d_%d.%s %dw", p.ID, w, getExtension(p.Mime), w))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// makeImageVariant は幅が width になるように縮小した画像を返す。元の幅が width 以下ならそのまま返す
+func makeImageVariant(data []byte, mime string, width int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return data, nil
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	buf := bytes.Buffer{}
+	switch mime {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: imageVariantJPEGQuality})
+	case "image/png":
+		err = png.Encode(&buf, dst)
+	default:
+		err = fmt.Errorf("cannot make a variant of %s", mime)
+	}
+	return buf.Bytes(), err
+}
+
+// getImageVariant は縮小画像を返す。まだ無ければ作って保存先に置く
+func getImageVariant(p imagePost, width int) (*storedImage, error) {
+	if !hasImageVariants(p.Mime) || !isImageVariantWidth(width) {
+		return nil, fs.ErrNotExist
+	}
+
+	name := imageVariantName(int64(p.ID), p.Mime, width)
+	img, err := imageStore.Get(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return img, err
+	}
+
+	v, err, _ := sf.Do("image_variant:"+name, func() (interface{}, error) {
+		orig, err := getImageWithFallback(p)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(orig)
+		orig.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		variant, err := makeImageVariant(data, p.Mime, width)
+		if err != nil {
+			return nil, err
+		}
+		if err := imageStore.Put(name, variant, p.Mime); err != nil {
+			log.Print(err)
+		}
+		return variant, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newStoredImage(v.([]byte), p.CreatedAt), nil
+}
+
+// deletePostImages は投稿の画像と縮小画像を消す
+func deletePostImages(pid int64, mime string) {
+	names := []string{imageName(pid, mime)}
+	if hasImageVariants(mime) {
+		for _, w := range imageVariantWidths {
+			names = append(names, imageVariantName(pid, mime, w))
+		}
+	}
+	for _, name := range names {
+		if err := imageStore.Delete(name); err != nil {
+			log.Print(err)
+		}
+	}
+}
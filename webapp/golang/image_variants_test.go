@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestParseImageName(t *testing.T) {
+	tests := []struct {
+		name       string
+		pid, width int
+		ok         bool
+	}{
+		{"12.jpg", 12, 0, true},
+		{"12_320.jpg", 12, 320, true},
+		{"12_0.jpg", 0, 0, false},
+		{"12_.png", 0, 0, false},
+		{"_320.png", 0, 0, false},
+		{"12_320", 0, 0, false},
+	}
+	for _, tt := range tests {
+		pid, width, ok := parseImageName(tt.name)
+		if pid != tt.pid || width != tt.width || ok != tt.ok {
+			t.Errorf("parseImageName(%q) = %d, %d, %v", tt.name, pid, width, ok)
+		}
+	}
+}
+
+func TestImageSrcset(t *testing.T) {
+	got := imageSrcset(Post{ID: 3, Mime: "image/png"})
+	want := "/image/3_320.png 320w, /image/3_640.png 640w, /image/3_1280.png 1280w"
+	if got != want {
+		t.Errorf("imageSrcset = %q, want %q", got, want)
+	}
+	if got := imageSrcset(Post{ID: 3, Mime: "image/gif"}); got != "" {
+		t.Errorf("expected no srcset for gif, got %q", got)
+	}
+}
+
+func TestMakeImageVariant(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2000, 1000))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	v, err := makeImageVariant(data, "image/png", 640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 640 || config.Height != 320 {
+		t.Errorf("unexpected size %dx%d", config.Width, config.Height)
+	}
+
+	// 元の幅より大きくはしない
+	v, err = makeImageVariant(data, "image/png", 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, data) {
+		t.Error("expected the original image to be returned")
+	}
+}
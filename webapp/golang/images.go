@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 投稿画像の配信。投稿の画像は作り直さないので、長く変わらないものとしてキャッシュさせる。
+// ETag と Last-Modified は保存先によらず同じになるように、投稿IDと投稿日時とサイズから作る。
+// 保存先に画像が無いときは posts.imgdata から読み、保存先に書いておく。
+// その回数を /debug/vars の image_fallback に出すので、served が増えなくなれば imgdata は消してよい。
+
+const imageCacheControl = "public, max-age=31536000, immutable"
+
+var imageFallback = expvar.NewMap("image_fallback")
+
+type imagePost struct {
+	ID        int       `db:"id"`
+	Mime      string    `db:"mime"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// findImagePost は表示してよい投稿を返す。BANされたユーザーの投稿なら sql.ErrNoRows を返す
+func findImagePost(pid int) (imagePost, error) {
+	p := imagePost{}
+	err := db.Get(&p, "SELECT `posts`.`id`, `posts`.`mime`, `posts`.`created_at` FROM `posts` "+
+		"JOIN `users` ON `users`.`id` = `posts`.`user_id` WHERE `posts`.`id` = ? AND "+activeUserCondition, pid)
+	return p, err
+}
+
+func imageETag(p imagePost, width int, size int64) string {
+	if width > 0 {
+		return fmt.Sprintf(`"%d_%d-%d-%d"`, p.ID, width, p.CreatedAt.Unix(), size)
+	}
+	return fmt.Sprintf(`"%d-%d-%d"`, p.ID, p.CreatedAt.Unix(), size)
+}
+
+// getImage は /image/{id}.{ext} の画像と /image/{id}_{幅}.{ext} の縮小画像を返す。
+// 拡張子が投稿の形式と違えば 404 にする
+func getImage(w http.ResponseWriter, r *http.Request) {
+	pid, width, ok := parseImageName(chi.URLParam(r, "id") + "." + chi.URLParam(r, "ext"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	p, err := findImagePost(pid)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if ext := chi.URLParam(r, "ext"); ext == "" || ext != getExtension(p.Mime) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var img *storedImage
+	if width > 0 {
+		img, err = getImageVariant(p, width)
+	} else {
+		img, err = getImageWithFallback(p)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer img.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", p.Mime)
+	h.Set("Cache-Control", imageCacheControl)
+	h.Set("ETag", imageETag(p, width, img.Size))
+	// If-None-Match と If-Range、Range は ServeContent が扱う
+	http.ServeContent(w, r, "", p.CreatedAt, img)
+}
+
+// getImageWithFallback は保存先から画像を読む。無ければ posts.imgdata から読んで保存先に書く
+func getImageWithFallback(p imagePost) (*storedImage, error) {
+	name := imageName(int64(p.ID), p.Mime)
+	img, err := imageStore.Get(name)
+	if _, ok := imageStore.(dbImageStore); ok || !errors.Is(err, fs.ErrNotExist) {
+		return img, err
+	}
+
+	// 同じ画像へのリクエストが重なっても、読み込みと書き込みは1回にする
+	v, err, _ := sf.Do("image_fallback:"+name, func() (interface{}, error) {
+		blob, err := dbImageStore{}.Get(name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				imageFallback.Add("missing", 1)
+			}
+			return nil, err
+		}
+		defer blob.Close()
+
+		data := make([]byte, blob.Size)
+		if _, err := io.ReadFull(blob, data); err != nil {
+			return nil, err
+		}
+		imageFallback.Add("served", 1)
+		last := new(expvar.String)
+		last.Set(time.Now().Format(time.RFC3339))
+		imageFallback.Set("last_served_at", last)
+
+		if err := imageStore.Put(name, data, p.Mime); err != nil {
+			imageFallback.Add("write_errors", 1)
+			log.Print(err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newStoredImage(v.([]byte), p.CreatedAt), nil
+}
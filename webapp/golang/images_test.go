@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestGetImage(t *testing.T) {
+	oldStore := imageStore
+	imageStore = &localImageStore{dir: t.TempDir()}
+	t.Cleanup(func() { imageStore = oldStore })
+	if err := imageStore.Put("12.png", []byte("0123456789"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	post := imagePost{ID: 12, Mime: "image/png", CreatedAt: createdAt}
+	etag := imageETag(post, 0, 10)
+
+	router := chi.NewRouter()
+	router.Get("/image/{id}.{ext}", getImage)
+
+	tests := []struct {
+		name    string
+		path    string
+		header  map[string]string
+		visible bool
+		status  int
+		body    string
+	}{
+		{"full", "/image/12.png", nil, true, http.StatusOK, "0123456789"},
+		{"not modified", "/image/12.png", map[string]string{"If-None-Match": etag}, true, http.StatusNotModified, ""},
+		{"range", "/image/12.png", map[string]string{"Range": "bytes=2-5"}, true, http.StatusPartialContent, "2345"},
+		{"stale if-range", "/image/12.png", map[string]string{"Range": "bytes=2-5", "If-Range": `"12-0-0"`}, true, http.StatusOK, "0123456789"},
+		{"wrong extension", "/image/12.jpg", nil, true, http.StatusNotFound, ""},
+		{"banned author", "/image/12.png", nil, false, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			rows := sqlmock.NewRows([]string{"id", "mime", "created_at"})
+			if tt.visible {
+				rows.AddRow(post.ID, post.Mime, post.CreatedAt)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT `posts`.`id`, `posts`.`mime`, `posts`.`created_at` FROM `posts`")).
+				WithArgs(12).
+				WillReturnRows(rows)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+			if tt.status == http.StatusOK || tt.status == http.StatusPartialContent {
+				if got := w.Header().Get("ETag"); got != etag {
+					t.Errorf("ETag = %q, want %q", got, etag)
+				}
+				if got := w.Header().Get("Cache-Control"); got != imageCacheControl {
+					t.Errorf("Cache-Control = %q", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// トップページのキャッシュの作り直し方
+type indexCachePolicy int
+
+const (
+	// 変更があれば次の読み込みで必ず作り直す
+	indexCacheImmediate indexCachePolicy = iota
+	// 変更が debounce の間止まるまでは古い内容を返す
+	indexCacheDebounced
+	// 最初の変更から maxStaleness が経つまでは古い内容を返す
+	indexCacheMaxStaleness
+)
+
+type indexCacheConfig struct {
+	policy       indexCachePolicy
+	debounce     time.Duration
+	maxStaleness time.Duration
+}
+
+func loadIndexCacheConfig() indexCacheConfig {
+	c := indexCacheConfig{
+		policy:       indexCacheImmediate,
+		debounce:     500 * time.Millisecond,
+		maxStaleness: 0,
+	}
+
+	switch p := os.Getenv("ISUCONP_INDEX_CACHE_POLICY"); p {
+	case "", "immediate":
+	case "debounce", "debounced":
+		c.policy = indexCacheDebounced
+		// 投稿が途切れなくても作り直されるように上限を設ける
+		c.maxStaleness = 3 * time.Second
+	case "max-staleness":
+		c.policy = indexCacheMaxStaleness
+		c.maxStaleness = time.Second
+	default:
+		log.Printf("unknown ISUCONP_INDEX_CACHE_POLICY %q, falling back to immediate", p)
+	}
+
+	if s := os.Getenv("ISUCONP_INDEX_CACHE_DEBOUNCE"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Printf("invalid ISUCONP_INDEX_CACHE_DEBOUNCE %q: %s", s, err)
+		} else {
+			c.debounce = d
+		}
+	}
+	if s := os.Getenv("ISUCONP_INDEX_CACHE_MAX_STALENESS"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Printf("invalid ISUCONP_INDEX_CACHE_MAX_STALENESS %q: %s", s, err)
+		} else {
+			c.maxStaleness = d
+		}
+	}
+
+	return c
+}
+
+// indexCache はトップページの投稿部分を描画済みの文字列として持つ。
+// 変更イベントを受けると世代を進め、読み込み時にポリシーに従って作り直すか判断する。
+type indexCache struct {
+	mu     sync.RWMutex
+	config indexCacheConfig
+
+	content  string
+	built    bool
+	builtGen uint64
+
+	dirtyGen     uint64
+	firstDirtyAt time.Time
+	lastDirtyAt  time.Time
+}
+
+func newIndexCache(config indexCacheConfig) *indexCache {
+	return &indexCache{config: config}
+}
+
+func (c *indexCache) markDirty(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dirtyGen == c.builtGen {
+		c.firstDirtyAt = now
+	}
+	c.dirtyGen++
+	c.lastDirtyAt = now
+}
+
+// get はキャッシュをそのまま返してよければ内容と true を返す
+func (c *indexCache) get(now time.Time) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.built {
+		return "", false
+	}
+	if c.dirtyGen == c.builtGen {
+		return c.content, true
+	}
+
+	switch c.config.policy {
+	case indexCacheDebounced:
+		if c.config.maxStaleness > 0 && now.Sub(c.firstDirtyAt) >= c.config.maxStaleness {
+			return "", false
+		}
+		if now.Sub(c.lastDirtyAt) < c.config.debounce {
+			return c.content, true
+		}
+	case indexCacheMaxStaleness:
+		if now.Sub(c.firstDirtyAt) < c.config.maxStaleness {
+			return c.content, true
+		}
+	}
+
+	return "", false
+}
+
+// generation は作り直しを始める前に呼び、その時点の世代を set に渡す。
+// 作り直し中に届いたイベントは次の読み込みで反映される。
+func (c *indexCache) generation() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dirtyGen
+}
+
+func (c *indexCache) set(content string, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.content = content
+	c.built = true
+	c.builtGen = gen
+}
+
+var (
+	timelineSubscribersMu sync.RWMutex
+	timelineSubscribers   []func(reason string)
+)
+
+// subscribeTimelineDirty はタイムラインが変わったときに呼ばれる関数を登録する
+func subscribeTimelineDirty(f func(reason string)) {
+	timelineSubscribersMu.Lock()
+	defer timelineSubscribersMu.Unlock()
+	timelineSubscribers = append(timelineSubscribers, f)
+}
+
+// publishTimelineDirty は投稿・コメント・BANなどタイムラインに影響する書き込みの後に呼ぶ
+func publishTimelineDirty(reason string) {
+	timelineSubscribersMu.RLock()
+	defer timelineSubscribersMu.RUnlock()
+	for _, f := range timelineSubscribers {
+		f(reason)
+	}
+}
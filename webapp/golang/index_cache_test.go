@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIndexCacheGet(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+
+	immediate := indexCacheConfig{policy: indexCacheImmediate}
+	debounced := indexCacheConfig{policy: indexCacheDebounced, debounce: 500 * time.Millisecond}
+	debouncedCapped := indexCacheConfig{policy: indexCacheDebounced, debounce: 500 * time.Millisecond, maxStaleness: time.Second}
+	maxStaleness := indexCacheConfig{policy: indexCacheMaxStaleness, maxStaleness: time.Second}
+
+	tests := []struct {
+		name   string
+		config indexCacheConfig
+		dirty  []int
+		now    int
+		hit    bool
+	}{
+		{"clean", immediate, nil, 0, true},
+		{"immediate dirty", immediate, []int{0}, 0, false},
+		{"debounce while writes continue", debounced, []int{0, 300, 600}, 900, true},
+		{"debounce after writes stop", debounced, []int{0, 300}, 800, false},
+		{"debounce capped by max staleness", debouncedCapped, []int{0, 300, 600, 900}, 1000, false},
+		{"max staleness within the limit", maxStaleness, []int{0, 900}, 999, true},
+		{"max staleness past the limit", maxStaleness, []int{0, 900}, 1000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newIndexCache(tt.config)
+			c.set("cached", c.generation())
+			for _, ms := range tt.dirty {
+				c.markDirty(at(ms))
+			}
+
+			content, hit := c.get(at(tt.now))
+			if hit != tt.hit {
+				t.Fatalf("get() hit = %v, want %v", hit, tt.hit)
+			}
+			if hit && content != "cached" {
+				t.Errorf("get() = %q", content)
+			}
+		})
+	}
+}
+
+func TestIndexCacheGeneration(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newIndexCache(indexCacheConfig{policy: indexCacheImmediate})
+
+	if _, hit := c.get(now); hit {
+		t.Fatal("expected a miss before the first build")
+	}
+
+	// 作り直しの途中で変更が届いたら、作った内容は古いものとして扱う
+	gen := c.generation()
+	c.markDirty(now)
+	c.set("stale", gen)
+	if _, hit := c.get(now); hit {
+		t.Error("expected a write during the rebuild to leave the cache dirty")
+	}
+
+	c.set("fresh", c.generation())
+	if content, hit := c.get(now); !hit || content != "fresh" {
+		t.Errorf("get() = %q, %v", content, hit)
+	}
+}
+
+func TestLoadIndexCacheConfig(t *testing.T) {
+	t.Setenv("ISUCONP_INDEX_CACHE_DEBOUNCE", "")
+	t.Setenv("ISUCONP_INDEX_CACHE_MAX_STALENESS", "")
+
+	tests := []struct {
+		policy string
+		want   indexCacheConfig
+	}{
+		{"", indexCacheConfig{policy: indexCacheImmediate, debounce: 500 * time.Millisecond}},
+		{"debounce", indexCacheConfig{policy: indexCacheDebounced, debounce: 500 * time.Millisecond, maxStaleness: 3 * time.Second}},
+		{"max-staleness", indexCacheConfig{policy: indexCacheMaxStaleness, debounce: 500 * time.Millisecond, maxStaleness: time.Second}},
+	}
+	for _, tt := range tests {
+		t.Setenv("ISUCONP_INDEX_CACHE_POLICY", tt.policy)
+		if got := loadIndexCacheConfig(); got != tt.want {
+			t.Errorf("loadIndexCacheConfig() with %q = %+v, want %+v", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ログインの失敗回数をアカウントごと・IPごとに数え、上限を超えたらしばらくログインさせない。
+//   - ISUCONP_LOGIN_LIMIT: on で有効にする。ベンチマーカーは1つのアドレスから失敗し続けるので既定は無効
+//   - ISUCONP_LOGIN_LIMIT_STORE: memory (デフォルト) か memcache。複数台で動かすときは memcache
+//   - ISUCONP_LOGIN_LIMIT_ACCOUNT / ISUCONP_LOGIN_LIMIT_IP: ウィンドウ内で許す失敗回数
+//   - ISUCONP_LOGIN_LIMIT_WINDOW / ISUCONP_LOGIN_LIMIT_COOLDOWN: 数える期間とロックする期間
+//   - ISUCONP_LOGIN_LIMIT_EXEMPT_NETS: 数えないアドレス (CIDR のカンマ区切り)。ベンチマーカーなど
+//
+// クライアントのIPは、直接の接続元が ISUCONP_TRUSTED_PROXIES に含まれるときだけ X-Real-IP を信じる。
+
+const loginLimitedMessage = "ログインの失敗が続いたため、しばらくログインできません。時間をおいてから再度お試しください"
+
+type loginLimitConfig struct {
+	Enabled        bool
+	Store          string
+	AccountLimit   int
+	IPLimit        int
+	Window         time.Duration
+	Cooldown       time.Duration
+	ExemptNets     []*net.IPNet
+	TrustedProxies []*net.IPNet
+}
+
+func loadLoginLimitConfig() loginLimitConfig {
+	c := loginLimitConfig{
+		Enabled:      os.Getenv("ISUCONP_LOGIN_LIMIT") == "on",
+		Store:        os.Getenv("ISUCONP_LOGIN_LIMIT_STORE"),
+		AccountLimit: envInt("ISUCONP_LOGIN_LIMIT_ACCOUNT", 5),
+		IPLimit:      envInt("ISUCONP_LOGIN_LIMIT_IP", 50),
+		Window:       envDuration("ISUCONP_LOGIN_LIMIT_WINDOW", 5*time.Minute),
+		Cooldown:     envDuration("ISUCONP_LOGIN_LIMIT_COOLDOWN", 15*time.Minute),
+		ExemptNets:   parseNets(os.Getenv("ISUCONP_LOGIN_LIMIT_EXEMPT_NETS")),
+	}
+
+	proxies := os.Getenv("ISUCONP_TRUSTED_PROXIES")
+	if proxies == "" {
+		proxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16"
+	}
+	c.TrustedProxies = parseNets(proxies)
+
+	if c.Window <= 0 || c.Cooldown <= 0 {
+		log.Print("ISUCONP_LOGIN_LIMIT_WINDOW and ISUCONP_LOGIN_LIMIT_COOLDOWN must be positive, login limiting is disabled")
+		c.Enabled = false
+	}
+	return c
+}
+
+func envInt(key string, def int) int {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.Printf("invalid %s %q", key, s)
+		return def
+	}
+	return n
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Printf("invalid %s %q", key, s)
+		return def
+	}
+	return d
+}
+
+// parseNets は CIDR か単独のアドレスをカンマ区切りで読む
+func parseNets(s string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Printf("invalid network %q", v)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginCounterStore は期限付きのカウンタを置く場所
+type loginCounterStore interface {
+	incr(key string, ttl time.Duration) (uint64, error)
+	get(keys ...string) (map[string]uint64, error)
+	set(key string, value uint64, ttl time.Duration) error
+	delete(key string) error
+}
+
+type loginLimiter struct {
+	config loginLimitConfig
+	store  loginCounterStore
+	now    func() time.Time
+}
+
+func newLoginLimiter(c loginLimitConfig, client *memcache.Client) *loginLimiter {
+	var s loginCounterStore
+	switch c.Store {
+	case "", "memory":
+		s = newMemoryCounterStore()
+	case "memcache", "memcached":
+		s = memcacheCounterStore{client}
+	default:
+		log.Printf("unknown ISUCONP_LOGIN_LIMIT_STORE %q, using memory", c.Store)
+		s = newMemoryCounterStore()
+	}
+	return &loginLimiter{config: c, store: s, now: time.Now}
+}
+
+// clientIP はリクエスト元のIPを返す
+func (l *loginLimiter) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && containsIP(l.config.TrustedProxies, ip) {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real
+		}
+	}
+	return ip
+}
+
+// subjects はロックと失敗回数を数える対象と、それぞれの上限を返す
+func (l *loginLimiter) subjects(accountName string, ip net.IP) map[string]int {
+	subjects := map[string]int{}
+	// 規則に合わない名前のアカウントは存在しないのでIPだけで数える
+	if l.config.AccountLimit > 0 && len(accountName) <= 64 && accountNameRegexp.MatchString(accountName) {
+		subjects["account:"+strings.ToLower(accountName)] = l.config.AccountLimit
+	}
+	if l.config.IPLimit > 0 && ip != nil {
+		subjects["ip:"+ip.String()] = l.config.IPLimit
+	}
+	return subjects
+}
+
+func (l *loginLimiter) exempt(ip net.IP) bool {
+	return !l.config.Enabled || (ip != nil && containsIP(l.config.ExemptNets, ip))
+}
+
+// locked はロック中ならロックが解けるまでの時間を返す
+func (l *loginLimiter) locked(accountName string, ip net.IP) (time.Duration, bool) {
+	if l.exempt(ip) {
+		return 0, false
+	}
+
+	keys := []string{}
+	for s := range l.subjects(accountName, ip) {
+		keys = append(keys, loginLockKey(s))
+	}
+	values, err := l.store.get(keys...)
+	if err != nil {
+		// 数えられないときはログインを止めない
+		log.Print(err)
+		return 0, false
+	}
+
+	now := l.now().Unix()
+	var retryAfter time.Duration
+	for _, until := range values {
+		if d := time.Duration(int64(until)-now) * time.Second; d > retryAfter {
+			retryAfter = d
+		}
+	}
+	return retryAfter, retryAfter > 0
+}
+
+// failed は失敗を記録し、上限に達したらロックする
+func (l *loginLimiter) failed(accountName string, ip net.IP) (time.Duration, bool) {
+	if l.exempt(ip) {
+		return 0, false
+	}
+
+	now := l.now()
+	current, previous, elapsed := l.windows(now)
+	locked := false
+	for s, limit := range l.subjects(accountName, ip) {
+		n, err := l.store.incr(loginCountKey(s, current), 2*l.config.Window)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		values, err := l.store.get(loginCountKey(s, previous))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		// 直前のウィンドウの回数を経過時間に応じて減らしてスライディングウィンドウを近似する
+		count := float64(n) + float64(values[loginCountKey(s, previous)])*(1-elapsed)
+		if count < float64(limit) {
+			continue
+		}
+
+		until := now.Add(l.config.Cooldown).Unix()
+		if err := l.store.set(loginLockKey(s), uint64(until), l.config.Cooldown); err != nil {
+			log.Print(err)
+			continue
+		}
+		locked = true
+	}
+
+	if !locked {
+		return 0, false
+	}
+	return l.config.Cooldown, true
+}
+
+// succeeded はアカウントの失敗回数を消す。IPごとの回数は残す
+func (l *loginLimiter) succeeded(accountName string) {
+	if !l.config.Enabled || l.config.AccountLimit <= 0 || !accountNameRegexp.MatchString(accountName) {
+		return
+	}
+	current, previous, _ := l.windows(l.now())
+	s := "account:" + strings.ToLower(accountName)
+	for _, key := range []string{loginCountKey(s, current), loginCountKey(s, previous)} {
+		if err := l.store.delete(key); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// windows は今と直前のウィンドウの番号と、今のウィンドウの経過割合を返す
+func (l *loginLimiter) windows(now time.Time) (current, previous int64, elapsed float64) {
+	w := int64(l.config.Window)
+	n := now.UnixNano()
+	current = n / w
+	return current, current - 1, float64(n%w) / float64(w)
+}
+
+// retryAfterSeconds は Retry-After ヘッダに入れる秒数を返す
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+func loginCountKey(subject string, window int64) string {
+	return "isuconp_login_count:" + subject + ":" + strconv.FormatInt(window, 10)
+}
+
+func loginLockKey(subject string) string {
+	return "isuconp_login_lock:" + subject
+}
+
+// memcacheCounterStore は memcached にカウンタを置く
+type memcacheCounterStore struct {
+	client *memcache.Client
+}
+
+func (s memcacheCounterStore) incr(key string, ttl time.Duration) (uint64, error) {
+	for i := 0; i < 2; i++ {
+		n, err := s.client.Increment(key, 1)
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			return n, err
+		}
+		err = s.client.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: int32(ttl.Seconds())})
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return 1, err
+		}
+		// 他のリクエストが先に作ったのでもう一度足す
+	}
+	return s.client.Increment(key, 1)
+}
+
+func (s memcacheCounterStore) get(keys ...string) (map[string]uint64, error) {
+	items, err := s.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]uint64{}
+	for k, item := range items {
+		n, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[k] = n
+	}
+	return values, nil
+}
+
+func (s memcacheCounterStore) set(key string, value uint64, ttl time.Duration) error {
+	return s.client.Set(&memcache.Item{Key: key, Value: []byte(strconv.FormatUint(value, 10)), Expiration: int32(ttl.Seconds())})
+}
+
+func (s memcacheCounterStore) delete(key string) error {
+	err := s.client.Delete(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
+
+// memoryCounterStore はプロセス内にカウンタを置く
+type memoryCounterStore struct {
+	mu     sync.Mutex
+	values map[string]memoryCounter
+	writes int
+}
+
+type memoryCounter struct {
+	value     uint64
+	expiresAt time.Time
+}
+
+func newMemoryCounterStore() *memoryCounterStore {
+	return &memoryCounterStore{values: map[string]memoryCounter{}}
+}
+
+func (s *memoryCounterStore) incr(key string, ttl time.Duration) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	c, ok := s.values[key]
+	if !ok || now.After(c.expiresAt) {
+		c = memoryCounter{expiresAt: now.Add(ttl)}
+	}
+	c.value++
+	s.values[key] = c
+	s.sweep(now)
+	return c.value, nil
+}
+
+func (s *memoryCounterStore) get(keys ...string) (map[string]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	values := map[string]uint64{}
+	for _, k := range keys {
+		if c, ok := s.values[k]; ok && !now.After(c.expiresAt) {
+			values[k] = c.value
+		}
+	}
+	return values, nil
+}
+
+func (s *memoryCounterStore) set(key string, value uint64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.values[key] = memoryCounter{value: value, expiresAt: now.Add(ttl)}
+	s.sweep(now)
+	return nil
+}
+
+func (s *memoryCounterStore) delete(key string) error {
+	s.mu.Lock()
+	delete(s.values, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// sweep は期限切れのカウンタをときどきまとめて捨てる。mu を持った状態で呼ぶ
+func (s *memoryCounterStore) sweep(now time.Time) {
+	s.writes++
+	if s.writes%1024 != 0 {
+		return
+	}
+	for k, c := range s.values {
+		if now.After(c.expiresAt) {
+			delete(s.values, k)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestLoginLimiter(now *time.Time) *loginLimiter {
+	l := newLoginLimiter(loginLimitConfig{
+		Enabled:        true,
+		AccountLimit:   3,
+		IPLimit:        10,
+		Window:         time.Minute,
+		Cooldown:       5 * time.Minute,
+		ExemptNets:     parseNets("192.0.2.0/24"),
+		TrustedProxies: parseNets("127.0.0.1"),
+	}, nil)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLoginLimiterLocksAccount(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLoginLimiter(&now)
+	ip := net.ParseIP("198.51.100.1")
+
+	for i := 0; i < 2; i++ {
+		if _, locked := l.failed("mary", ip); locked {
+			t.Fatalf("locked after %d failures", i+1)
+		}
+	}
+	if _, locked := l.failed("mary", ip); !locked {
+		t.Fatal("expected the third failure to lock the account")
+	}
+
+	if d, locked := l.locked("MARY", net.ParseIP("198.51.100.2")); !locked || d != 5*time.Minute {
+		t.Errorf("expected the account to be locked from another address, got (%v, %v)", d, locked)
+	}
+	if _, locked := l.locked("bob", ip); locked {
+		t.Error("expected another account from the same address to be allowed")
+	}
+
+	now = now.Add(5 * time.Minute)
+	if _, locked := l.locked("mary", ip); locked {
+		t.Error("expected the lock to expire after the cooldown")
+	}
+}
+
+func TestLoginLimiterSuccessResetsAccount(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLoginLimiter(&now)
+	ip := net.ParseIP("198.51.100.1")
+
+	l.failed("mary", ip)
+	l.failed("mary", ip)
+	l.succeeded("mary")
+	if _, locked := l.failed("mary", ip); locked {
+		t.Error("expected a successful login to reset the account's failures")
+	}
+}
+
+func TestLoginLimiterExemptNets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLoginLimiter(&now)
+	ip := net.ParseIP("192.0.2.10")
+
+	for i := 0; i < 20; i++ {
+		if _, locked := l.failed("mary", ip); locked {
+			t.Fatal("expected an exempt address never to be locked")
+		}
+	}
+}
+
+func TestLoginLimiterClientIP(t *testing.T) {
+	now := time.Now()
+	l := newTestLoginLimiter(&now)
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	r.Header.Set("X-Real-IP", "198.51.100.1")
+	if ip := l.clientIP(r); !ip.Equal(net.ParseIP("198.51.100.1")) {
+		t.Errorf("expected X-Real-IP from a trusted proxy, got %v", ip)
+	}
+
+	r.RemoteAddr = "203.0.113.1:12345"
+	if ip := l.clientIP(r); !ip.Equal(net.ParseIP("203.0.113.1")) {
+		t.Errorf("expected X-Real-IP from an untrusted client to be ignored, got %v", ip)
+	}
+}
+
+// replayBenchmarkLogins はベンチマーカーの loginScenarioCh と同じ割合でログインを試す。
+// 2つのワーカーがそれぞれ、正しいログイン、存在しないユーザー、間違ったパスワードを繰り返す。
+// 正しいログインがロックされたら false を返す
+func replayBenchmarkLogins(l *loginLimiter, now *time.Time, ip net.IP) bool {
+	start := *now
+	for i := 0; now.Sub(start) < time.Minute; i++ {
+		for worker := 0; worker < 2; worker++ {
+			if _, locked := l.locked("user"+strconv.Itoa(i%100), ip); locked {
+				return false
+			}
+			l.failed("nonexistent"+strconv.Itoa(i), ip)
+			l.failed("user"+strconv.Itoa((i+50)%100), ip)
+		}
+		*now = now.Add(50 * time.Millisecond)
+	}
+	return true
+}
+
+func TestLoginLimiterBenchmarkTraffic(t *testing.T) {
+	for _, key := range []string{"ISUCONP_LOGIN_LIMIT", "ISUCONP_LOGIN_LIMIT_STORE", "ISUCONP_LOGIN_LIMIT_ACCOUNT", "ISUCONP_LOGIN_LIMIT_IP",
+		"ISUCONP_LOGIN_LIMIT_WINDOW", "ISUCONP_LOGIN_LIMIT_COOLDOWN", "ISUCONP_LOGIN_LIMIT_EXEMPT_NETS"} {
+		t.Setenv(key, "")
+	}
+	ip := net.ParseIP("192.0.2.10")
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		allowed bool
+	}{
+		{"default", nil, true},
+		{"enabled", map[string]string{"ISUCONP_LOGIN_LIMIT": "on"}, false},
+		{"enabled with the benchmarker exempt", map[string]string{"ISUCONP_LOGIN_LIMIT": "on", "ISUCONP_LOGIN_LIMIT_EXEMPT_NETS": "192.0.2.0/24"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			l := newLoginLimiter(loadLoginLimitConfig(), nil)
+			l.now = func() time.Time { return now }
+
+			if allowed := replayBenchmarkLogins(l, &now, ip); allowed != tt.allowed {
+				t.Errorf("expected the benchmark's logins to be allowed = %v", tt.allowed)
+			}
+		})
+	}
+}
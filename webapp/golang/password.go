@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// パスワードは bcrypt で保存する。
+// 以前の sha512(password + ":" + sha512(accountName)) 形式のハッシュは、
+// ログインに成功したときに bcrypt で保存し直す。
+
+var bcryptCost = loadBcryptCost()
+
+func loadBcryptCost() int {
+	s := os.Getenv("ISUCONP_BCRYPT_COST")
+	if s == "" {
+		return bcrypt.DefaultCost
+	}
+	cost, err := strconv.Atoi(s)
+	if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		log.Printf("invalid ISUCONP_BCRYPT_COST %q", s)
+		return bcrypt.DefaultCost
+	}
+	return cost
+}
+
+func hashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// isLegacyPasshash は passhash が以前の sha512 形式かを返す
+func isLegacyPasshash(passhash string) bool {
+	return !strings.HasPrefix(passhash, "$2")
+}
+
+// verifyPassword はパスワードが正しいかと、保存し直すべきかを返す
+func verifyPassword(u User, password string) (ok bool, needsRehash bool) {
+	if isLegacyPasshash(u.Passhash) {
+		h := calculatePasshash(u.AccountName, password)
+		ok = subtle.ConstantTimeCompare([]byte(h), []byte(u.Passhash)) == 1
+		return ok, ok
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.Passhash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(u.Passhash))
+	return true, err != nil || cost != bcryptCost
+}
+
+// rehashPassword は確認済みのパスワードを現在の方式で保存し直す
+func rehashPassword(u *User, password string) {
+	h, err := hashPassword(password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// 同時に別の更新があった場合は上書きしない
+	_, err = db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ? AND `passhash` = ?", h, u.ID, u.Passhash)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	u.Passhash = h
+}
+
+type passhashReport struct {
+	Total  int `json:"total" db:"total"`
+	Legacy int `json:"legacy" db:"legacy"`
+	Bcrypt int `json:"bcrypt" db:"bcrypt"`
+}
+
+// getPasshashReport は古い形式のハッシュのままのアカウント数を数える
+func getPasshashReport() (passhashReport, error) {
+	report := passhashReport{}
+	err := db.Get(&report, "SELECT COUNT(*) AS `total`, "+
+		"COALESCE(SUM(`passhash` NOT LIKE '$2%'), 0) AS `legacy`, "+
+		"COALESCE(SUM(`passhash` LIKE '$2%'), 0) AS `bcrypt` "+
+		"FROM `users`")
+	return report, err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	legacy := User{AccountName: "mary", Passhash: calculatePasshash("mary", "marymary")}
+
+	if ok, needsRehash := verifyPassword(legacy, "marymary"); !ok || !needsRehash {
+		t.Errorf("expected a legacy hash to verify and need a rehash, got (%v, %v)", ok, needsRehash)
+	}
+	if ok, _ := verifyPassword(legacy, "wrong"); ok {
+		t.Errorf("expected a wrong password to be rejected")
+	}
+
+	h, err := bcrypt.GenerateFromPassword([]byte("marymary"), bcryptCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := User{AccountName: "mary", Passhash: string(h)}
+
+	if ok, needsRehash := verifyPassword(current, "marymary"); !ok || needsRehash {
+		t.Errorf("expected a bcrypt hash to verify without a rehash, got (%v, %v)", ok, needsRehash)
+	}
+	if ok, _ := verifyPassword(current, "wrong"); ok {
+		t.Errorf("expected a wrong password to be rejected")
+	}
+
+	h, err = bcrypt.GenerateFromPassword([]byte("marymary"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheap := User{AccountName: "mary", Passhash: string(h)}
+	if _, needsRehash := verifyPassword(cheap, "marymary"); needsRehash != (bcryptCost != bcrypt.MinCost) {
+		t.Errorf("expected a hash with a different cost to need a rehash")
+	}
+}
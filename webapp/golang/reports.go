@@ -0,0 +1,496 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 投稿とコメントの通報。同じユーザーは同じ対象を1回だけ通報できる。
+// 管理者用の /admin/reports には未対応の通報を対象ごとにまとめて、通報の多い順に出す。
+// 対応すると、その対象への未対応の通報をまとめて閉じる。
+
+type reportReason string
+
+const (
+	reportReasonSpam          reportReason = "spam"
+	reportReasonHarassment    reportReason = "harassment"
+	reportReasonInappropriate reportReason = "inappropriate"
+	reportReasonCopyright     reportReason = "copyright"
+	reportReasonOther         reportReason = "other"
+
+	reportTargetPost    = "post"
+	reportTargetComment = "comment"
+
+	reportStatusOpen      = "open"
+	reportStatusDismissed = "dismissed"
+	reportStatusRemoved   = "removed"
+	reportStatusBanned    = "banned"
+
+	reportQueuePerPage = 50
+)
+
+type reportReasonOption struct {
+	Reason reportReason
+	Label  string
+}
+
+// reportReasons は通報するときに選べる理由
+var reportReasons = []reportReasonOption{
+	{reportReasonSpam, "スパム"},
+	{reportReasonHarassment, "嫌がらせ"},
+	{reportReasonInappropriate, "不適切な内容"},
+	{reportReasonCopyright, "著作権の侵害"},
+	{reportReasonOther, "その他"},
+}
+
+var (
+	errReportReason     validationError = "通報の理由を選んでください"
+	errReportNotFound   validationError = "通報する対象が見つかりません"
+	errReportOwn        validationError = "自分の投稿やコメントは通報できません"
+	errReportDetail     validationError = "詳細は255文字以内で入力してください"
+	errReportAction     validationError = "不明な操作です"
+	errReportBan        validationError = "BANする権限がありません"
+	errReportBanSkipped validationError = "投稿者をBANできませんでした。スタッフや存在しないユーザーはBANできません"
+)
+
+func isReportReason(s string) bool {
+	return slices.ContainsFunc(reportReasons, func(o reportReasonOption) bool {
+		return string(o.Reason) == s
+	})
+}
+
+func reportReasonLabel(s string) string {
+	for _, o := range reportReasons {
+		if string(o.Reason) == s {
+			return o.Label
+		}
+	}
+	return s
+}
+
+// reportTarget は通報された投稿かコメント
+type reportTarget struct {
+	Type   string
+	ID     int
+	PostID int    `db:"post_id"`
+	UserID int    `db:"user_id"`
+	Author string `db:"account_name"`
+	Text   string `db:"text"`
+}
+
+// loadReportTarget は通報された投稿かコメントを読む。見つからなければ errReportNotFound を返す
+func loadReportTarget(targetType string, id int) (reportTarget, error) {
+	t := reportTarget{Type: targetType, ID: id}
+
+	var query string
+	switch targetType {
+	case reportTargetPost:
+		query = "SELECT `posts`.`id` AS `post_id`, `posts`.`user_id`, `users`.`account_name`, `posts`.`body` AS `text` " +
+			"FROM `posts` JOIN `users` ON `users`.`id` = `posts`.`user_id` WHERE `posts`.`id` = ?"
+	case reportTargetComment:
+		query = "SELECT `comments`.`post_id`, `comments`.`user_id`, `users`.`account_name`, `comments`.`comment` AS `text` " +
+			"FROM `comments` JOIN `users` ON `users`.`id` = `comments`.`user_id` WHERE `comments`.`id` = ?"
+	default:
+		return t, errReportNotFound
+	}
+
+	err := db.Get(&t, query, id)
+	if err == sql.ErrNoRows {
+		return t, errReportNotFound
+	}
+	return t, err
+}
+
+// loadVisibleReportTarget は表示されている投稿と、その投稿へのコメントだけを返す。
+// BANされたユーザーの投稿など、見えないものは errReportNotFound にする
+func loadVisibleReportTarget(targetType string, id int) (reportTarget, error) {
+	t, err := loadReportTarget(targetType, id)
+	if err != nil {
+		return t, err
+	}
+	if ok, err := postExists(t.PostID); err != nil || !ok {
+		if err == nil {
+			err = errReportNotFound
+		}
+		return t, err
+	}
+	return t, nil
+}
+
+// createReport は me が対象を通報する。同じ対象をもう一度通報したときは理由を更新する
+func createReport(me User, targetType string, targetID int, reason, detail string) (reportTarget, error) {
+	if !isReportReason(reason) {
+		return reportTarget{}, errReportReason
+	}
+	if utf8.RuneCountInString(detail) > 255 {
+		return reportTarget{}, errReportDetail
+	}
+
+	t, err := loadVisibleReportTarget(targetType, targetID)
+	if err != nil {
+		return t, err
+	}
+	if t.UserID == me.ID {
+		return t, errReportOwn
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `reports` (`reporter_id`, `target_type`, `target_id`, `post_id`, `reason`, `detail`) VALUES (?,?,?,?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `reason` = VALUES(`reason`), `detail` = VALUES(`detail`), `status` = '"+reportStatusOpen+"', `resolved_by` = NULL, `resolved_at` = NULL",
+		me.ID, targetType, targetID, t.PostID, reason, detail,
+	)
+	return t, err
+}
+
+// ReportedItem は /admin/reports に出す、未対応の通報がある対象
+type ReportedItem struct {
+	TargetType      string    `db:"target_type"`
+	TargetID        int       `db:"target_id"`
+	PostID          int       `db:"post_id"`
+	ReportCount     int       `db:"report_count"`
+	Reasons         string    `db:"reasons"`
+	FirstReportedAt time.Time `db:"first_reported_at"`
+	LastReportedAt  time.Time `db:"last_reported_at"`
+	// 対象がすでに消えていればゼロ値
+	Target reportTarget
+	// 理由ごとの件数を表示用にしたもの
+	ReasonLabels []string
+}
+
+// listReportedItems は未対応の通報を対象ごとにまとめ、通報の多い順に返す
+func listReportedItems(limit int) ([]ReportedItem, error) {
+	items := []ReportedItem{}
+	err := db.Select(&items, "SELECT `target_type`, `target_id`, MAX(`post_id`) AS `post_id`, COUNT(*) AS `report_count`, "+
+		"GROUP_CONCAT(`reason` ORDER BY `reason`) AS `reasons`, MIN(`created_at`) AS `first_reported_at`, MAX(`created_at`) AS `last_reported_at` "+
+		"FROM `reports` WHERE `status` = ? GROUP BY `target_type`, `target_id` "+
+		"ORDER BY `report_count` DESC, `first_reported_at` ASC LIMIT ?", reportStatusOpen, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		t, err := loadReportTarget(items[i].TargetType, items[i].TargetID)
+		if err != nil && !errors.Is(err, errReportNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			items[i].Target = t
+		}
+		items[i].ReasonLabels = countReasons(items[i].Reasons)
+	}
+	return items, nil
+}
+
+// countReasons は "spam,spam,other" のような理由の一覧を "スパム ×2" のような表示にする
+func countReasons(reasons string) []string {
+	counts := map[string]int{}
+	order := []string{}
+	for _, r := range strings.Split(reasons, ",") {
+		if r == "" {
+			continue
+		}
+		if counts[r] == 0 {
+			order = append(order, r)
+		}
+		counts[r]++
+	}
+
+	labels := make([]string, 0, len(order))
+	for _, r := range order {
+		label := reportReasonLabel(r)
+		if counts[r] > 1 {
+			label += fmt.Sprintf(" ×%d", counts[r])
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// closeReports は対象への未対応の通報を status にして閉じ、閉じた件数を返す
+func closeReports(adminID int, targetType string, targetID int, status string) (int64, error) {
+	result, err := db.Exec(
+		"UPDATE `reports` SET `status` = ?, `resolved_by` = ?, `resolved_at` = NOW() WHERE `target_type` = ? AND `target_id` = ? AND `status` = ?",
+		status, adminID, targetType, targetID, reportStatusOpen,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// removePost は投稿とそのコメントと画像を削除する。削除したら true を返す
+func removePost(adminID int, pid int) (bool, error) {
+	mime := ""
+	err := db.Get(&mime, "SELECT `mime` FROM `posts` WHERE `id` = ?", pid)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM `comments` WHERE `post_id` = ?", pid); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM `posts` WHERE `id` = ?", pid); err != nil {
+		return false, err
+	}
+	// 投稿に付いたコメントへの通報もまとめて閉じる
+	_, err = tx.Exec("UPDATE `reports` SET `status` = ?, `resolved_by` = ?, `resolved_at` = NOW() WHERE `post_id` = ? AND `status` = ?",
+		reportStatusRemoved, adminID, pid, reportStatusOpen)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	deletePostImages(int64(pid), mime)
+	publishTimelineDirty("remove")
+	return true, nil
+}
+
+// removeComment はコメントを削除する。削除したら true を返す
+func removeComment(adminID int, id int) (bool, error) {
+	result, err := db.Exec("DELETE FROM `comments` WHERE `id` = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := closeReports(adminID, reportTargetComment, id, reportStatusRemoved); err != nil {
+		return true, err
+	}
+	publishTimelineDirty("remove")
+	return true, nil
+}
+
+var (
+	reportTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("report.html"),
+	))
+	adminReportsTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("reports.html"),
+	))
+)
+
+func getPostsIDReport(w http.ResponseWriter, r *http.Request) {
+	renderReport(w, r, reportTargetPost)
+}
+
+func getCommentsIDReport(w http.ResponseWriter, r *http.Request) {
+	renderReport(w, r, reportTargetComment)
+}
+
+func renderReport(w http.ResponseWriter, r *http.Request, targetType string) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	t, err := loadVisibleReportTarget(targetType, id)
+	if errors.Is(err, errReportNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	reportTemplate.Execute(w, struct {
+		Me        User
+		Target    reportTarget
+		Reasons   []reportReasonOption
+		Flash     string
+		CSRFToken string
+	}{me, t, reportReasons, getFlash(w, r, "notice"), getCSRFToken(r)})
+}
+
+func postReport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	targetType := r.FormValue("target_type")
+	targetID, err := strconv.Atoi(r.FormValue("target_id"))
+	if err != nil || (targetType != reportTargetPost && targetType != reportTargetComment) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = createReport(me, targetType, targetID, r.FormValue("reason"), strings.TrimSpace(r.FormValue("detail")))
+	if errors.Is(err, errReportNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	session := getSession(r)
+	var verr validationError
+	if errors.As(err, &verr) {
+		session.Values["notice"] = verr.Error()
+	} else if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else {
+		session.Values["notice"] = "通報を受け付けました"
+	}
+	session.Save(r, w)
+
+	http.Redirect(w, r, fmt.Sprintf("/%ss/%d/report", targetType, targetID), http.StatusFound)
+}
+
+func getAdminReports(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	items, err := listReportedItems(reportQueuePerPage)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	canBan, err := hasPermission(me, permBanUsers)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	adminReportsTemplate.Execute(w, struct {
+		Me        User
+		Items     []ReportedItem
+		CanBan    bool
+		Flash     string
+		CSRFToken string
+	}{me, items, canBan, getFlash(w, r, "notice"), getCSRFToken(r)})
+}
+
+// postAdminReportsResolve は通報された対象について、通報の却下・削除・投稿者のBANのどれかを行う
+func postAdminReportsResolve(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	targetType := r.FormValue("target_type")
+	targetID, err := strconv.Atoi(r.FormValue("target_id"))
+	if err != nil || (targetType != reportTargetPost && targetType != reportTargetComment) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = resolveReports(r, me, targetType, targetID, r.FormValue("action"))
+
+	var verr validationError
+	if errors.As(err, &verr) {
+		session := getSession(r)
+		session.Values["notice"] = verr.Error()
+		session.Save(r, w)
+	} else if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusFound)
+}
+
+func resolveReports(r *http.Request, me User, targetType string, targetID int, action string) error {
+	t, err := loadReportTarget(targetType, targetID)
+	if err != nil && !errors.Is(err, errReportNotFound) {
+		return err
+	}
+	target := auditTarget{Type: targetType, ID: targetID, Name: t.Author}
+	// 通報を閉じる前に理由を控えておく
+	reasons, err := openReportReasons(targetType, targetID)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "dismiss":
+		n, err := closeReports(me.ID, targetType, targetID, reportStatusDismissed)
+		recordAudit(r, me, auditActionDismissReport, target, auditOutcome(n > 0, err), fmt.Sprintf("reports=%d", n))
+		return err
+
+	case "remove":
+		var removed bool
+		if targetType == reportTargetPost {
+			removed, err = removePost(me.ID, targetID)
+			recordAudit(r, me, auditActionRemovePost, target, auditOutcome(removed, err), "reason="+reasons)
+		} else {
+			removed, err = removeComment(me.ID, targetID)
+			recordAudit(r, me, auditActionRemoveComment, target, auditOutcome(removed, err), "reason="+reasons)
+		}
+		if err == nil && !removed {
+			// 他の管理者が先に削除していたら残った通報だけ閉じる
+			_, err = closeReports(me.ID, targetType, targetID, reportStatusRemoved)
+		}
+		return err
+
+	case "ban":
+		if ok, err := hasPermission(me, permBanUsers); err != nil || !ok {
+			if err == nil {
+				err = errReportBan
+			}
+			return err
+		}
+		if t.UserID == 0 {
+			return errReportNotFound
+		}
+		if banUsers(r, me, []string{strconv.Itoa(t.UserID)}, "通報: "+reasons, nil) == 0 {
+			// BANできなかったときは通報を残しておく
+			return errReportBanSkipped
+		}
+		_, err := closeReports(me.ID, targetType, targetID, reportStatusBanned)
+		return err
+	}
+	return errReportAction
+}
+
+// openReportReasons は対象への未対応の通報の理由を重複なく並べる。監査ログと BANの理由に使う
+func openReportReasons(targetType string, targetID int) (string, error) {
+	reasons := []string{}
+	err := db.Select(&reasons, "SELECT DISTINCT `reason` FROM `reports` WHERE `target_type` = ? AND `target_id` = ? AND `status` = ? ORDER BY `reason`",
+		targetType, targetID, reportStatusOpen)
+	return strings.Join(reasons, ","), err
+}
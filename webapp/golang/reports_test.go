@@ -0,0 +1,17 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountReasons(t *testing.T) {
+	got := countReasons("other,spam,spam,unknown")
+	want := []string{"その他", "スパム ×2", "unknown"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v to eq %v", got, want)
+	}
+	if got := countReasons(""); len(got) != 0 {
+		t.Errorf("expected no labels, got %v", got)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 管理者の役割と権限。
+// users.authority は何かしらの役割を持っていれば 1 で、役割そのものは user_roles に置く。
+// user_roles に行が無い authority = 1 のユーザーは、以前からの管理者として admin 扱いにする。
+// 最初の superadmin は ISUCONP_SUPERADMINS にアカウント名をカンマ区切りで渡して決める。
+// 名前は起動時にユーザー ID に引いて user_roles に書き、以後は ID で判定する。
+
+type role string
+
+type permission string
+
+const (
+	roleNone       role = ""
+	roleModerator  role = "moderator"
+	roleAdmin      role = "admin"
+	roleSuperadmin role = "superadmin"
+
+	permBanUsers           permission = "ban_users"
+	permRemovePosts        permission = "remove_posts"
+	permViewAudit          permission = "view_audit"
+	permViewPasswordReport permission = "view_password_report"
+	permManageRoles        permission = "manage_roles"
+)
+
+var (
+	roles = []role{roleModerator, roleAdmin, roleSuperadmin}
+
+	// rolePermissions は役割ごとに許可する操作
+	rolePermissions = map[role][]permission{
+		roleModerator:  {permBanUsers, permRemovePosts},
+		roleAdmin:      {permBanUsers, permRemovePosts, permViewAudit, permViewPasswordReport},
+		roleSuperadmin: {permBanUsers, permRemovePosts, permViewAudit, permViewPasswordReport, permManageRoles},
+	}
+
+	superadminNames = parseSuperadminNames(os.Getenv("ISUCONP_SUPERADMINS"))
+
+	// superadminIDs は superadminNames を起動時にユーザー ID に引いたもの
+	superadminIDsMu sync.RWMutex
+	superadminIDs   = map[int]bool{}
+
+	errRoleUnknown    validationError = "不明な役割です"
+	errRoleForbidden  validationError = "この役割を変更する権限がありません"
+	errRoleSelf       validationError = "自分の役割は変更できません"
+	errRoleUserAbsent validationError = "ユーザーが見つかりません"
+)
+
+func parseSuperadminNames(s string) []string {
+	names := []string{}
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// bootstrapSuperadmins は ISUCONP_SUPERADMINS のユーザーに superadmin を付ける。
+// 名前を変えたユーザーは古い名前からたどり、見つからない名前は飛ばす
+func bootstrapSuperadmins() error {
+	ids := map[int]bool{}
+	for _, name := range superadminNames {
+		u := User{}
+		err := db.Get(&u, "SELECT * FROM `users` WHERE `account_name` = ?", name)
+		if err == sql.ErrNoRows {
+			var ok bool
+			if u, ok = findRenamedUser(name); !ok {
+				log.Printf("superadmin %q not found", name)
+				continue
+			}
+		} else if err != nil {
+			return err
+		}
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO `user_roles` (`user_id`, `role`) VALUES (?,?) "+
+				"ON DUPLICATE KEY UPDATE `role` = VALUES(`role`), `granted_by` = NULL, `granted_at` = NOW()",
+			u.ID, roleSuperadmin,
+		)
+		if err == nil {
+			_, err = tx.Exec("UPDATE `users` SET `authority` = 1 WHERE `id` = ?", u.ID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		invalidateUser(strconv.Itoa(u.ID))
+		ids[u.ID] = true
+	}
+
+	superadminIDsMu.Lock()
+	defer superadminIDsMu.Unlock()
+	superadminIDs = ids
+	return nil
+}
+
+// isConfiguredSuperadmin は ISUCONP_SUPERADMINS で決めた superadmin かを返す
+func isConfiguredSuperadmin(u User) bool {
+	superadminIDsMu.RLock()
+	defer superadminIDsMu.RUnlock()
+	return superadminIDs[u.ID]
+}
+
+// rank は役割の強さ。自分より弱い役割だけを付け外しできる
+func (r role) rank() int {
+	return slices.Index(roles, r) + 1
+}
+
+func (r role) can(p permission) bool {
+	return slices.Contains(rolePermissions[r], p)
+}
+
+// canManage は actor が target の役割を付けたり外したりできるかを返す。superadmin はすべて変更できる
+func (r role) canManage(target role) bool {
+	if !r.can(permManageRoles) {
+		return false
+	}
+	return r == roleSuperadmin || r.rank() > target.rank()
+}
+
+// getUserRole はユーザーの役割を返す
+func getUserRole(u User) (role, error) {
+	if isConfiguredSuperadmin(u) {
+		return roleSuperadmin, nil
+	}
+	if u.Authority == 0 {
+		return roleNone, nil
+	}
+
+	var s string
+	err := db.Get(&s, "SELECT `role` FROM `user_roles` WHERE `user_id` = ?", u.ID)
+	if err == sql.ErrNoRows {
+		return roleAdmin, nil
+	}
+	if err != nil {
+		return roleNone, err
+	}
+	return role(s), nil
+}
+
+func hasPermission(u User, p permission) (bool, error) {
+	r, err := getUserRole(u)
+	if err != nil {
+		return false, err
+	}
+	return r.can(p), nil
+}
+
+// requirePermission は管理者用ページのルートに付けるミドルウェア。
+// ログインしていなければトップページに、権限が無ければ 403 を返し、
+// 2段階認証が必須なのに有効にしていなければ設定ページに送る。
+func requirePermission(p permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			me := getSessionUser(r)
+			if !isLogin(me) {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+
+			ok, err := hasPermission(me, p)
+			if err != nil {
+				log.Print(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			if !requireAdminTwoFactor(w, r, me) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// StaffMember は役割を持つユーザー
+type StaffMember struct {
+	User
+	Role role
+	// 今のユーザーがこの役割を外せるか
+	Revocable bool
+}
+
+func listStaff() ([]StaffMember, error) {
+	users := []User{}
+	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` != 0 AND "+activeUserCondition+" ORDER BY `account_name`")
+	if err != nil {
+		return nil, err
+	}
+
+	staff := make([]StaffMember, 0, len(users))
+	for _, u := range users {
+		r, err := getUserRole(u)
+		if err != nil {
+			return nil, err
+		}
+		staff = append(staff, StaffMember{User: u, Role: r})
+	}
+	return staff, nil
+}
+
+// setUserRole は target の役割を newRole にする。roleNone なら役割を外す。
+// 変更前の役割を返す。
+func setUserRole(actor User, target User, newRole role) (role, error) {
+	if newRole != roleNone && !slices.Contains(roles, newRole) {
+		return roleNone, errRoleUnknown
+	}
+	if actor.ID == target.ID {
+		return roleNone, errRoleSelf
+	}
+
+	actorRole, err := getUserRole(actor)
+	if err != nil {
+		return roleNone, err
+	}
+	current, err := getUserRole(target)
+	if err != nil {
+		return roleNone, err
+	}
+	if !actorRole.canManage(current) || !actorRole.canManage(newRole) {
+		return current, errRoleForbidden
+	}
+	if isConfiguredSuperadmin(target) {
+		// 環境変数で決めた superadmin は画面からは変えられない
+		return current, errRoleForbidden
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return current, err
+	}
+	defer tx.Rollback()
+
+	if newRole == roleNone {
+		if _, err := tx.Exec("DELETE FROM `user_roles` WHERE `user_id` = ?", target.ID); err != nil {
+			return current, err
+		}
+		if _, err := tx.Exec("UPDATE `users` SET `authority` = 0 WHERE `id` = ?", target.ID); err != nil {
+			return current, err
+		}
+	} else {
+		_, err := tx.Exec(
+			"INSERT INTO `user_roles` (`user_id`, `role`, `granted_by`) VALUES (?,?,?) "+
+				"ON DUPLICATE KEY UPDATE `role` = VALUES(`role`), `granted_by` = VALUES(`granted_by`), `granted_at` = NOW()",
+			target.ID, newRole, actor.ID,
+		)
+		if err != nil {
+			return current, err
+		}
+		if _, err := tx.Exec("UPDATE `users` SET `authority` = 1 WHERE `id` = ?", target.ID); err != nil {
+			return current, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return current, err
+	}
+
+	invalidateUser(strconv.Itoa(target.ID))
+	return current, nil
+}
+
+var (
+	adminRolesTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("roles.html"),
+	))
+)
+
+func getAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	staff, err := listStaff()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	myRole, err := getUserRole(me)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for i := range staff {
+		staff[i].Revocable = staff[i].ID != me.ID && myRole.canManage(staff[i].Role)
+	}
+	assignable := []role{}
+	for _, ro := range roles {
+		if myRole.canManage(ro) {
+			assignable = append(assignable, ro)
+		}
+	}
+
+	adminRolesTemplate.Execute(w, struct {
+		Me         User
+		MyRole     role
+		Staff      []StaffMember
+		Assignable []role
+		Flash      string
+		CSRFToken  string
+	}{me, myRole, staff, assignable, getFlash(w, r, "notice"), getCSRFToken(r)})
+}
+
+func postAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	err := func() error {
+		target := User{}
+		err := db.Get(&target, "SELECT * FROM `users` WHERE `account_name` = ? AND "+activeUserCondition, r.FormValue("account_name"))
+		if err == sql.ErrNoRows {
+			return errRoleUserAbsent
+		}
+		if err != nil {
+			return err
+		}
+
+		newRole := role(r.FormValue("role"))
+		before, err := setUserRole(me, target, newRole)
+		recordAudit(r, me, auditActionRoleChange, userAuditTarget(target), auditOutcome(before != newRole, err),
+			"from="+string(before)+" to="+string(newRole))
+		return err
+	}()
+
+	var verr validationError
+	if errors.As(err, &verr) {
+		session := getSession(r)
+		session.Values["notice"] = verr.Error()
+		session.Save(r, w)
+	} else if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/roles", http.StatusFound)
+}
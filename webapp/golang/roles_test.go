@@ -0,0 +1,90 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRolePermissions(t *testing.T) {
+	if !roleModerator.can(permBanUsers) {
+		t.Error("expected moderator to ban users")
+	}
+	if roleModerator.can(permManageRoles) {
+		t.Error("expected moderator not to manage roles")
+	}
+	if roleAdmin.can(permManageRoles) {
+		t.Error("expected only superadmins to manage roles")
+	}
+	if roleNone.can(permBanUsers) {
+		t.Error("expected users without a role not to ban users")
+	}
+
+	tests := []struct {
+		actor, target role
+		want          bool
+	}{
+		{roleModerator, roleNone, false},
+		{roleModerator, roleModerator, false},
+		{roleAdmin, roleNone, false},
+		{roleAdmin, roleModerator, false},
+		{roleAdmin, roleAdmin, false},
+		{roleAdmin, roleSuperadmin, false},
+		{roleSuperadmin, roleAdmin, true},
+		{roleSuperadmin, roleSuperadmin, true},
+	}
+	for _, tt := range tests {
+		if got := tt.actor.canManage(tt.target); got != tt.want {
+			t.Errorf("%q.canManage(%q) = %v, want %v", tt.actor, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestBootstrapSuperadmins(t *testing.T) {
+	mock := useMockDB(t)
+	oldNames := superadminNames
+	superadminNames = []string{"root", "ghost"}
+	t.Cleanup(func() {
+		superadminNames = oldNames
+		superadminIDsMu.Lock()
+		superadminIDs = map[int]bool{}
+		superadminIDsMu.Unlock()
+	})
+	userColumns := []string{"id", "account_name", "passhash", "authority", "del_flg", "created_at", "ban_expires_at"}
+
+	// root は名前を変えているので古い名前からたどる
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `users` WHERE `account_name` = ?")).
+		WithArgs("root").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM `account_name_redirects`")).
+		WithArgs("root").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(3, "renamed", "", 0, 0, time.Now(), nil))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `user_roles`")).
+		WithArgs(3, roleSuperadmin).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `users` SET `authority` = 1 WHERE `id` = ?")).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `users` WHERE `account_name` = ?")).
+		WithArgs("ghost").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM `account_name_redirects`")).
+		WithArgs("ghost").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+
+	if err := bootstrapSuperadmins(); err != nil {
+		t.Fatal(err)
+	}
+
+	// アカウント名ではなく ID で判定する
+	if r, err := getUserRole(User{ID: 3, AccountName: "renamed", Authority: 1}); err != nil || r != roleSuperadmin {
+		t.Errorf("getUserRole(3) = %q, %v, want superadmin", r, err)
+	}
+	if r, err := getUserRole(User{ID: 4, AccountName: "root"}); err != nil || r != roleNone {
+		t.Errorf("getUserRole(4) = %q, %v, want no role", r, err)
+	}
+}
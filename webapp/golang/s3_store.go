@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 互換のオブジェクトストレージ。署名 (Signature Version 4) は自前で作る。
+// MinIO などでも使えるように、バケットはパスに含める形式で URL を組み立てる。
+//   ISUCONP_S3_ENDPOINT          例: https://s3.ap-northeast-1.amazonaws.com, http://minio:9000
+//   ISUCONP_S3_BUCKET
+//   ISUCONP_S3_REGION            既定は us-east-1
+//   ISUCONP_S3_PREFIX            オブジェクト名の前に付ける。例: image/
+//   ISUCONP_S3_ACCESS_KEY_ID
+//   ISUCONP_S3_SECRET_ACCESS_KEY
+
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3ImageStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	// テストで時刻を固定する
+	now func() time.Time
+}
+
+func loadS3ImageStore() (*s3ImageStore, error) {
+	endpoint := os.Getenv("ISUCONP_S3_ENDPOINT")
+	bucket := os.Getenv("ISUCONP_S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("ISUCONP_S3_ENDPOINT and ISUCONP_S3_BUCKET are required for the s3 image store")
+	}
+	region := os.Getenv("ISUCONP_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return newS3ImageStore(endpoint, bucket, region, os.Getenv("ISUCONP_S3_PREFIX"),
+		os.Getenv("ISUCONP_S3_ACCESS_KEY_ID"), os.Getenv("ISUCONP_S3_SECRET_ACCESS_KEY"))
+}
+
+func newS3ImageStore(endpoint, bucket, region, prefix, accessKey, secretKey string) (*s3ImageStore, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	return &s3ImageStore{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		now:       time.Now,
+	}, nil
+}
+
+// objectURL はオブジェクトの URL を返す。key が空ならバケットの URL
+func (s *s3ImageStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (s *s3ImageStore) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := s3EmptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	signS3Request(req, payloadHash, s.accessKey, s.secretKey, s.region, s.now())
+	return s.client.Do(req)
+}
+
+// s3Error はレスポンスの本文から S3 のエラーを作る
+func s3Error(res *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	e := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: %s %s: %s", res.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3: %s", res.Status)
+}
+
+func (s *s3ImageStore) Put(name string, data []byte, mime string) error {
+	header := http.Header{}
+	header.Set("Content-Type", mime)
+	res, err := s.do(http.MethodPut, s.prefix+name, nil, data, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *s3ImageStore) Get(name string) (*storedImage, error) {
+	res, err := s.do(http.MethodGet, s.prefix+name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s3Error(res)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	modTime, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err != nil {
+		modTime = time.Time{}
+	}
+	return newStoredImage(data, modTime), nil
+}
+
+func (s *s3ImageStore) Delete(name string) error {
+	res, err := s.do(http.MethodDelete, s.prefix+name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *s3ImageStore) DeleteAfter(maxPostID int) error {
+	token := ""
+	for {
+		keys, next, err := s.list(token)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			id, ok := imageNamePostID(strings.TrimPrefix(key, s.prefix))
+			if !ok || id <= maxPostID {
+				continue
+			}
+			if err := s.Delete(strings.TrimPrefix(key, s.prefix)); err != nil {
+				log.Print(err)
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
+}
+
+// list は prefix 以下のオブジェクト名を返す。続きがあれば次に渡すトークンも返す
+func (s *s3ImageStore) list(token string) ([]string, string, error) {
+	q := url.Values{"list-type": {"2"}}
+	if s.prefix != "" {
+		q.Set("prefix", s.prefix)
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	res, err := s.do(http.MethodGet, "", q, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", s3Error(res)
+	}
+
+	result := struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}{}
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]string, 0, len(result.Contents))
+	for _, c := range result.Contents {
+		keys = append(keys, c.Key)
+	}
+	if !result.IsTruncated {
+		return keys, "", nil
+	}
+	return keys, result.NextContinuationToken, nil
+}
+
+// signS3Request は Signature Version 4 の Authorization ヘッダーを付ける。
+// Host と、その時点で req.Header にあるすべてのヘッダーに署名する。
+func signS3Request(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape は英数字と -._~ 以外をすべてエスケープする
+func s3Escape(s string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	pairs := []string{}
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
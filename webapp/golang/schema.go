@@ -0,0 +1,139 @@
+package main
+
+// 初期データのダンプに含まれないテーブル。起動時に無ければ作る
+var schemaStatements = []string{
+	"CREATE TABLE IF NOT EXISTS `access_tokens` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"`user_id` int NOT NULL, " +
+		"`name` varchar(64) NOT NULL, " +
+		"`token_hash` char(64) NOT NULL, " +
+		"`scopes` varchar(255) NOT NULL, " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"`last_used_at` timestamp NULL DEFAULT NULL, " +
+		"`revoked_at` timestamp NULL DEFAULT NULL, " +
+		"UNIQUE KEY `token_hash` (`token_hash`), " +
+		"KEY `user_id` (`user_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `two_factors` (" +
+		"`user_id` int NOT NULL PRIMARY KEY, " +
+		"`secret` varchar(64) NOT NULL, " +
+		"`last_used_step` bigint NOT NULL DEFAULT 0, " +
+		"`enabled_at` timestamp NULL DEFAULT NULL, " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `recovery_codes` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"`user_id` int NOT NULL, " +
+		"`code_hash` char(64) NOT NULL, " +
+		"`used_at` timestamp NULL DEFAULT NULL, " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"KEY `user_id` (`user_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `account_name_redirects` (" +
+		"`account_name` varchar(64) NOT NULL PRIMARY KEY, " +
+		"`user_id` int NOT NULL, " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"KEY `user_id` (`user_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `user_sessions` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"`user_id` int NOT NULL, " +
+		"`sid_hash` char(64) NOT NULL, " +
+		"`user_agent` varchar(255) NOT NULL DEFAULT '', " +
+		"`ip` varchar(45) NOT NULL DEFAULT '', " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"`last_seen_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"`revoked_at` timestamp NULL DEFAULT NULL, " +
+		"UNIQUE KEY `sid_hash` (`sid_hash`), " +
+		"KEY `user_id` (`user_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `bans` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"`user_id` int NOT NULL, " +
+		"`admin_id` int NULL DEFAULT NULL, " +
+		"`reason` varchar(255) NOT NULL DEFAULT '', " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"`expires_at` timestamp NULL DEFAULT NULL, " +
+		"`lifted_at` timestamp NULL DEFAULT NULL, " +
+		"`lifted_by` int NULL DEFAULT NULL, " +
+		"KEY `user_id` (`user_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `audit_logs` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"`actor_id` int NOT NULL, " +
+		"`actor_account_name` varchar(64) NOT NULL, " +
+		"`action` varchar(32) NOT NULL, " +
+		"`target_type` varchar(16) NOT NULL, " +
+		"`target_id` int NULL DEFAULT NULL, " +
+		"`target_name` varchar(64) NOT NULL DEFAULT '', " +
+		"`ip` varchar(45) NOT NULL DEFAULT '', " +
+		"`outcome` varchar(16) NOT NULL, " +
+		"`detail` varchar(1000) NULL DEFAULT NULL, " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"KEY `action` (`action`, `id`), " +
+		"KEY `actor_account_name` (`actor_account_name`, `id`), " +
+		"KEY `target_name` (`target_name`, `id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `user_roles` (" +
+		"`user_id` int NOT NULL PRIMARY KEY, " +
+		"`role` varchar(16) NOT NULL, " +
+		"`granted_by` int NULL DEFAULT NULL, " +
+		"`granted_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `reports` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"`reporter_id` int NOT NULL, " +
+		"`target_type` varchar(16) NOT NULL, " +
+		"`target_id` int NOT NULL, " +
+		"`post_id` int NOT NULL, " +
+		"`reason` varchar(32) NOT NULL, " +
+		"`detail` varchar(255) NOT NULL DEFAULT '', " +
+		"`status` varchar(16) NOT NULL DEFAULT 'open', " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"`resolved_by` int NULL DEFAULT NULL, " +
+		"`resolved_at` timestamp NULL DEFAULT NULL, " +
+		"UNIQUE KEY `reporter_target` (`reporter_id`, `target_type`, `target_id`), " +
+		"KEY `status_target` (`status`, `target_type`, `target_id`), " +
+		"KEY `post_id` (`post_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// ISUCONP_IMAGE_STORE=db のときの縮小画像
+	"CREATE TABLE IF NOT EXISTS `image_variants` (" +
+		"`name` varchar(64) NOT NULL PRIMARY KEY, " +
+		"`post_id` int NOT NULL, " +
+		"`data` mediumblob NOT NULL, " +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"KEY `post_id` (`post_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+// 初期データのテーブルに足すカラム。無ければ足す
+var schemaColumns = []struct {
+	Table      string
+	Column     string
+	Definition string
+}{
+	{"users", "ban_expires_at", "timestamp NULL DEFAULT NULL"},
+}
+
+func migrateSchema() error {
+	for _, s := range schemaStatements {
+		if _, err := db.Exec(s); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range schemaColumns {
+		exists := 0
+		err := db.Get(&exists, "SELECT COUNT(*) FROM `information_schema`.`COLUMNS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ? AND `COLUMN_NAME` = ?", c.Table, c.Column)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE `" + c.Table + "` ADD COLUMN `" + c.Column + "` " + c.Definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	cmap "github.com/orcaman/concurrent-map/v2"
+)
+
+// ログイン中のセッションを user_sessions に記録する。
+// セッションには登録時に作った sid を持たせ、リクエストのたびに失効していないか確かめる。
+// 確認結果は sessionCheckInterval の間だけプロセス内に持つ。ユーザーや BANでまとめて失効させたときは
+// 世代番号を進めて他のノードにも捨てさせる。ログアウトでは他のノードは確かめ直しを待つ。
+
+const (
+	coherenceSessionsKey = "isuconp_gen_sessions"
+
+	// この間隔より古い確認結果は DB で確かめ直し、最終アクセス時刻も更新する
+	sessionCheckInterval = time.Minute
+)
+
+type UserSession struct {
+	ID         int          `db:"id"`
+	UserID     int          `db:"user_id"`
+	SIDHash    string       `db:"sid_hash"`
+	UserAgent  string       `db:"user_agent"`
+	IP         string       `db:"ip"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastSeenAt time.Time    `db:"last_seen_at"`
+	RevokedAt  sql.NullTime `db:"revoked_at"`
+}
+
+type checkedSession struct {
+	UserID    int
+	CheckedAt time.Time
+}
+
+var sessionChecks = cmap.New[checkedSession]()
+
+func init() {
+	cacheCoherence.watch(coherenceSessionsKey, func() {
+		sessionChecks.Clear()
+	})
+}
+
+// registerSession はログインしたセッションを記録し、セッションに持たせる sid を返す
+func registerSession(r *http.Request, u User) (string, error) {
+	sid := secureRandomStr(32)
+
+	ua := r.UserAgent()
+	for len(ua) > 255 {
+		_, size := utf8.DecodeLastRuneInString(ua)
+		ua = ua[:len(ua)-size]
+	}
+	ip := ""
+	if addr := loginLimit.clientIP(r); addr != nil {
+		ip = addr.String()
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO `user_sessions` (`user_id`, `sid_hash`, `user_agent`, `ip`) VALUES (?,?,?,?)",
+		u.ID, hashAccessToken(sid), ua, ip,
+	)
+	if err != nil {
+		return "", err
+	}
+	sessionChecks.Set(sid, checkedSession{UserID: u.ID, CheckedAt: time.Now()})
+	return sid, nil
+}
+
+// isSessionActive は sid が userID のセッションとして失効せずに残っているかを返す
+func isSessionActive(sid string, userID int) bool {
+	if sid == "" {
+		return false
+	}
+	if c, ok := sessionChecks.Get(sid); ok && time.Since(c.CheckedAt) < sessionCheckInterval {
+		return c.UserID == userID
+	}
+
+	s := UserSession{}
+	err := db.Get(&s, "SELECT * FROM `user_sessions` WHERE `sid_hash` = ? AND `revoked_at` IS NULL", hashAccessToken(sid))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Print(err)
+		}
+		sessionChecks.Remove(sid)
+		return false
+	}
+
+	if _, err := db.Exec("UPDATE `user_sessions` SET `last_seen_at` = NOW() WHERE `id` = ?", s.ID); err != nil {
+		log.Print(err)
+	}
+	sessionChecks.Set(sid, checkedSession{UserID: s.UserID, CheckedAt: time.Now()})
+	return s.UserID == userID
+}
+
+func listUserSessions(userID int) ([]UserSession, error) {
+	ss := []UserSession{}
+	err := db.Select(&ss, "SELECT * FROM `user_sessions` WHERE `user_id` = ? AND `revoked_at` IS NULL ORDER BY `last_seen_at` DESC, `id` DESC", userID)
+	return ss, err
+}
+
+// revokeSession は userID 自身のセッションだけを失効させる
+func revokeSession(userID, id int) (bool, error) {
+	result, err := db.Exec("UPDATE `user_sessions` SET `revoked_at` = NOW() WHERE `id` = ? AND `user_id` = ? AND `revoked_at` IS NULL", id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if n > 0 {
+		forgetSessionChecks()
+	}
+	return n > 0, err
+}
+
+func revokeSessionBySID(sid string) error {
+	if sid == "" {
+		return nil
+	}
+	_, err := db.Exec("UPDATE `user_sessions` SET `revoked_at` = NOW() WHERE `sid_hash` = ? AND `revoked_at` IS NULL", hashAccessToken(sid))
+	// ログアウトのたびに全ノードのキャッシュを捨てると確かめ直しが集中するので、手元の1件だけ捨てる
+	sessionChecks.Remove(sid)
+	return err
+}
+
+// revokeUserSessions はユーザーのすべてのセッションを失効させる
+func revokeUserSessions(userID int) error {
+	_, err := db.Exec("UPDATE `user_sessions` SET `revoked_at` = NOW() WHERE `user_id` = ? AND `revoked_at` IS NULL", userID)
+	forgetSessionChecks()
+	return err
+}
+
+// evictSessionChecks は確かめ直しの間隔を過ぎた確認結果を捨てる
+func evictSessionChecks(now time.Time) {
+	for sid, c := range sessionChecks.Items() {
+		if now.Sub(c.CheckedAt) >= sessionCheckInterval {
+			sessionChecks.RemoveCb(sid, func(_ string, v checkedSession, exists bool) bool {
+				// 確かめ直したばかりのものは残す
+				return exists && now.Sub(v.CheckedAt) >= sessionCheckInterval
+			})
+		}
+	}
+}
+
+// runSessionCheckEvictor は古い確認結果を定期的に捨てる。一度しか来ないセッションで増え続けないようにする
+func runSessionCheckEvictor() {
+	go func() {
+		ticker := time.NewTicker(sessionCheckInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			evictSessionChecks(now)
+		}
+	}()
+}
+
+func forgetSessionChecks() {
+	sessionChecks.Clear()
+	cacheCoherence.bump(coherenceSessionsKey)
+}
+
+func currentSessionID(r *http.Request) string {
+	sid, _ := getSession(r).Values["sid"].(string)
+	return sid
+}
+
+// endSession は今のセッションを失効させて Cookie を消す
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if err := revokeSessionBySID(currentSessionID(r)); err != nil {
+		log.Print(err)
+	}
+
+	session := getSession(r)
+	delete(session.Values, "user_id")
+	delete(session.Values, "sid")
+	session.Options = &sessions.Options{MaxAge: -1}
+	session.Save(r, w)
+}
+
+var (
+	sessionsTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("sessions.html"),
+	))
+)
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	ss, err := listUserSessions(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	sessionsTemplate.Execute(w, struct {
+		Me          User
+		Sessions    []UserSession
+		CurrentHash string
+		CSRFToken   string
+	}{me, ss, hashAccessToken(currentSessionID(r)), getCSRFToken(r)})
+}
+
+func postSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, err := revokeSession(me.ID, id); err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
+
+// postSessionsRevokeAll は今のセッションも含めてすべてログアウトさせる
+func postSessionsRevokeAll(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := revokeUserSessions(me.ID); err != nil {
+		log.Print(err)
+		return
+	}
+	endSession(w, r)
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+// useMockDB は db を sqlmock に差し替え、他のノードへの通知を止める
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	mdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB, oldCoherence := db, cacheCoherence
+	db = sqlx.NewDb(mdb, "mysql")
+	cacheCoherence = newCoherence(&fakeGenerations{values: map[string]uint64{}}, 0)
+	t.Cleanup(func() {
+		db, cacheCoherence = oldDB, oldCoherence
+		mdb.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+var userSessionColumns = []string{"id", "user_id", "sid_hash", "user_agent", "ip", "created_at", "last_seen_at", "revoked_at"}
+
+func TestIsSessionActiveUsesCachedCheck(t *testing.T) {
+	mock := useMockDB(t)
+	sessionChecks.Clear()
+	t.Cleanup(sessionChecks.Clear)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `user_sessions` WHERE `sid_hash` = ?")).
+		WithArgs(hashAccessToken("sid-1")).
+		WillReturnRows(sqlmock.NewRows(userSessionColumns).
+			AddRow(1, 7, hashAccessToken("sid-1"), "", "", time.Now(), time.Now(), nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `user_sessions` SET `last_seen_at` = NOW()")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// 2回目は DB を見ない
+	for i := 0; i < 2; i++ {
+		if !isSessionActive("sid-1", 7) {
+			t.Fatalf("expected the session to be active on check %d", i+1)
+		}
+	}
+	if isSessionActive("sid-1", 8) {
+		t.Error("expected the session not to belong to another user")
+	}
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	mock := useMockDB(t)
+	sessionChecks.Clear()
+	t.Cleanup(sessionChecks.Clear)
+	sessionChecks.Set("sid-1", checkedSession{UserID: 7, CheckedAt: time.Now()})
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `user_sessions` SET `revoked_at` = NOW() WHERE `user_id` = ?")).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `user_sessions` WHERE `sid_hash` = ?")).
+		WithArgs(hashAccessToken("sid-1")).
+		WillReturnRows(sqlmock.NewRows(userSessionColumns))
+
+	if err := revokeUserSessions(7); err != nil {
+		t.Fatal(err)
+	}
+	// 手元の確認結果を捨てているので、失効したことが DB から読まれる
+	if isSessionActive("sid-1", 7) {
+		t.Error("expected a revoked session to be inactive")
+	}
+}
+
+func TestBanUserRevokesSessions(t *testing.T) {
+	mock := useMockDB(t)
+	sessionChecks.Clear()
+	t.Cleanup(sessionChecks.Clear)
+	sessionChecks.Set("sid-1", checkedSession{UserID: 7, CheckedAt: time.Now()})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `users` WHERE `id` = ? AND `authority` = 0 FOR UPDATE")).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_name", "passhash", "authority", "del_flg", "created_at", "ban_expires_at"}).
+			AddRow(7, "mary", "", 0, 0, time.Now(), nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `users` SET `del_flg` = 1")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `bans` SET `lifted_at` = NOW()")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `bans`")).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `user_sessions` SET `revoked_at` = NOW() WHERE `user_id` = ?")).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	u, err := banUser(1, 7, "spam", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 7 {
+		t.Errorf("expected user 7 to be banned, got %d", u.ID)
+	}
+	if _, ok := sessionChecks.Get("sid-1"); ok {
+		t.Error("expected the banned user's cached sessions to be dropped")
+	}
+}
+
+func TestEvictSessionChecks(t *testing.T) {
+	sessionChecks.Clear()
+	t.Cleanup(sessionChecks.Clear)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sessionChecks.Set("old", checkedSession{UserID: 7, CheckedAt: now.Add(-sessionCheckInterval)})
+	sessionChecks.Set("fresh", checkedSession{UserID: 7, CheckedAt: now.Add(-time.Second)})
+
+	evictSessionChecks(now)
+	if _, ok := sessionChecks.Get("old"); ok {
+		t.Error("expected a check past the interval to be evicted")
+	}
+	if _, ok := sessionChecks.Get("fresh"); !ok {
+		t.Error("expected a recent check to be kept")
+	}
+}
+
+func TestRevokeSessionBySIDKeepsOtherChecks(t *testing.T) {
+	mock := useMockDB(t)
+	// 世代番号が進んだかを見られるように通知を有効にする。poll は回さない
+	generations := &fakeGenerations{values: map[string]uint64{}}
+	cacheCoherence = newCoherence(generations, time.Hour)
+	sessionChecks.Clear()
+	t.Cleanup(sessionChecks.Clear)
+	sessionChecks.Set("sid-1", checkedSession{UserID: 7, CheckedAt: time.Now()})
+	sessionChecks.Set("sid-2", checkedSession{UserID: 8, CheckedAt: time.Now()})
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `user_sessions` SET `revoked_at` = NOW() WHERE `sid_hash` = ?")).
+		WithArgs(hashAccessToken("sid-1")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := revokeSessionBySID("sid-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sessionChecks.Get("sid-1"); ok {
+		t.Error("expected the logged out session to be dropped")
+	}
+	if _, ok := sessionChecks.Get("sid-2"); !ok {
+		t.Error("expected other sessions to stay cached")
+	}
+	if len(generations.values) != 0 {
+		t.Errorf("expected logout not to bump the generation, got %v", generations.values)
+	}
+}
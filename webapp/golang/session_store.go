@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// セッションの保存先は ISUCONP_SESSION_STORE で選ぶ。
+//   - memcache (デフォルト): Cookie にはセッションIDだけを持ち、値は memcached に置く
+//   - cookie: 値を署名・暗号化して Cookie に置く
+//   - memory: 値をプロセス内に置く。1台構成やテスト用
+//
+// 鍵は ISUCONP_SESSION_SECRET で渡す。鍵を入れ替えるときは古い鍵を
+// ISUCONP_SESSION_OLD_SECRETS にカンマ区切りで並べておくと、古い鍵で作った Cookie も読める。
+
+const (
+	sessionKeyPrefix     = "iscogram_"
+	defaultSessionMaxAge = 86400 * 30
+)
+
+func newSessionStore(client *memcache.Client) (sessions.Store, error) {
+	secrets := sessionSecrets()
+
+	switch kind := os.Getenv("ISUCONP_SESSION_STORE"); kind {
+	case "", "memcache", "memcached":
+		return gsm.NewMemcacheStore(client, sessionKeyPrefix, sessionKeyPairs(secrets, false)...), nil
+	case "cookie":
+		s := sessions.NewCookieStore(sessionKeyPairs(secrets, true)...)
+		s.Options.MaxAge = defaultSessionMaxAge
+		return s, nil
+	case "memory":
+		return newMemoryStore(sessionKeyPairs(secrets, false)...), nil
+	default:
+		return nil, fmt.Errorf("unknown ISUCONP_SESSION_STORE %q", kind)
+	}
+}
+
+// sessionSecrets は現在の鍵を先頭に、古い鍵を続けて返す
+func sessionSecrets() []string {
+	current := os.Getenv("ISUCONP_SESSION_SECRET")
+	if current == "" {
+		log.Print("ISUCONP_SESSION_SECRET is not set, using the default secret")
+		current = "sendagaya"
+	}
+
+	secrets := []string{current}
+	for _, s := range strings.Split(os.Getenv("ISUCONP_SESSION_OLD_SECRETS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets
+}
+
+// sessionKeyPairs は securecookie に渡す鍵の組を作る。
+// 署名鍵は鍵をそのまま使い、暗号化するときは鍵から AES-256 の鍵を導出する。
+func sessionKeyPairs(secrets []string, encrypt bool) [][]byte {
+	pairs := make([][]byte, 0, len(secrets)*2)
+	for _, s := range secrets {
+		var blockKey []byte
+		if encrypt {
+			sum := sha256.Sum256([]byte("iscogram-session-block:" + s))
+			blockKey = sum[:]
+		}
+		pairs = append(pairs, []byte(s), blockKey)
+	}
+	return pairs
+}
+
+// memoryStore はセッションの値をプロセス内のマップに置く sessions.Store
+type memoryStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	mu       sync.Mutex
+	sessions map[string]memorySession
+	saves    int
+}
+
+type memorySession struct {
+	values    map[interface{}]interface{}
+	expiresAt time.Time
+}
+
+func newMemoryStore(keyPairs ...[]byte) *memoryStore {
+	return &memoryStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: defaultSessionMaxAge,
+		},
+		sessions: map[string]memorySession{},
+	}
+}
+
+func (s *memoryStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *memoryStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.sessions[session.ID]
+	if !ok || time.Now().After(stored.expiresAt) {
+		delete(s.sessions, session.ID)
+		return session, nil
+	}
+	for k, v := range stored.values {
+		session.Values[k] = v
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *memoryStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		s.mu.Lock()
+		delete(s.sessions, session.ID)
+		s.mu.Unlock()
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.sessions[session.ID] = memorySession{
+		values:    values,
+		expiresAt: now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+	// 期限切れのセッションはときどきまとめて捨てる
+	s.saves++
+	if s.saves%1024 == 0 {
+		for id, stored := range s.sessions {
+			if now.After(stored.expiresAt) {
+				delete(s.sessions, id)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// saveAndReload は store に値を保存し、返ってきた Cookie を付けたリクエストで読み直す
+func saveAndReload(t *testing.T, saveStore, loadStore sessions.Store) *sessions.Session {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session, err := saveStore.Get(r, "isuconp-go.session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user_id"] = 42
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	session, _ = loadStore.Get(r, "isuconp-go.session")
+	return session
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore(sessionKeyPairs([]string{"secret"}, false)...)
+
+	session := saveAndReload(t, store, store)
+	if session.IsNew || session.Values["user_id"] != 42 {
+		t.Errorf("expected the saved session to be loaded, got %v", session.Values)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session.Options.MaxAge = -1
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("expected the session to be deleted")
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	old := sessions.NewCookieStore(sessionKeyPairs([]string{"old"}, true)...)
+	rotated := sessions.NewCookieStore(sessionKeyPairs([]string{"new", "old"}, true)...)
+	other := sessions.NewCookieStore(sessionKeyPairs([]string{"new"}, true)...)
+
+	if session := saveAndReload(t, old, rotated); session.Values["user_id"] != 42 {
+		t.Errorf("expected a cookie made with the old secret to be readable after rotation")
+	}
+	if session := saveAndReload(t, old, other); session.Values["user_id"] != nil {
+		t.Errorf("expected a cookie made with an unknown secret to be rejected")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// アカウント設定。パスワードの変更、アカウント名の変更、退会ができる。
+// どの操作も現在のパスワードを入力して本人であることを確かめてから行う。
+// 変更前のアカウント名は account_name_redirects に残し、古い /@name から新しいページへ転送する。
+
+var (
+	passwordRegexp = regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`)
+
+	errWrongPassword      validationError = "パスワードが間違っています"
+	errPasswordFormat     validationError = "パスワードは6文字以上である必要があります"
+	errAccountNameFormat  validationError = "アカウント名は3文字以上である必要があります"
+	errAccountNameTaken   validationError = "アカウント名がすでに使われています"
+	errAccountNameNoop    validationError = "現在のアカウント名と同じです"
+	errAdminCannotDelete  validationError = "管理者は退会できません"
+	errDeleteConfirmation validationError = "確認のためアカウント名を入力してください"
+)
+
+// isAccountNameTaken は登録済みのアカウント名か、他のユーザーが以前使っていたアカウント名なら true を返す
+func isAccountNameTaken(accountName string, userID int) (bool, error) {
+	exists := 0
+	err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM `users` WHERE `account_name` = ?) "+
+		"OR EXISTS(SELECT 1 FROM `account_name_redirects` WHERE `account_name` = ? AND `user_id` != ?)",
+		accountName, accountName, userID)
+	return exists == 1, err
+}
+
+// findRenamedUser はアカウント名を変更したユーザーを古いアカウント名から探す
+func findRenamedUser(accountName string) (User, bool) {
+	u := User{}
+	err := db.Get(&u, "SELECT `users`.* FROM `account_name_redirects` "+
+		"JOIN `users` ON `users`.`id` = `account_name_redirects`.`user_id` "+
+		"WHERE `account_name_redirects`.`account_name` = ? AND "+activeUserCondition, accountName)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Print(err)
+		}
+		return User{}, false
+	}
+	return u, true
+}
+
+// redirectRenamedUser は古いアカウント名へのリクエストを path(新しいアカウント名) に転送する。転送したら true を返す
+func redirectRenamedUser(w http.ResponseWriter, r *http.Request, accountName string, path func(string) string) bool {
+	u, ok := findRenamedUser(accountName)
+	if !ok {
+		return false
+	}
+	location := path(u.AccountName)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, location, http.StatusMovedPermanently)
+	return true
+}
+
+func changePassword(me User, current, password string) error {
+	if ok, _ := verifyPassword(me, current); !ok {
+		return errWrongPassword
+	}
+	if !passwordRegexp.MatchString(password) {
+		return errPasswordFormat
+	}
+
+	passhash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ?", passhash, me.ID); err != nil {
+		return err
+	}
+	invalidateUser(strconv.Itoa(me.ID))
+	return nil
+}
+
+// changeAccountName はアカウント名を変更し、古いアカウント名からの転送を登録する。
+// 以前の形式のパスワードハッシュはアカウント名を含むので、ここでパスワードも保存し直す。
+func changeAccountName(me User, accountName, password string) error {
+	if ok, _ := verifyPassword(me, password); !ok {
+		return errWrongPassword
+	}
+	if !accountNameRegexp.MatchString(accountName) {
+		return errAccountNameFormat
+	}
+	if accountName == me.AccountName {
+		return errAccountNameNoop
+	}
+
+	taken, err := isAccountNameTaken(accountName, me.ID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errAccountNameTaken
+	}
+
+	passhash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 自分が以前使っていた名前に戻すときは転送をやめる
+	if _, err := tx.Exec("DELETE FROM `account_name_redirects` WHERE `account_name` = ? AND `user_id` = ?", accountName, me.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO `account_name_redirects` (`account_name`, `user_id`) VALUES (?,?)", me.AccountName, me.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `users` SET `account_name` = ?, `passhash` = ? WHERE `id` = ?", accountName, passhash, me.ID)
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) && merr.Number == 1062 {
+		// 確認してから更新するまでの間に同じ名前で登録された
+		return errAccountNameTaken
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	invalidateUser(strconv.Itoa(me.ID))
+	// タイムラインにアカウント名が含まれている
+	publishTimelineDirty("rename")
+	return nil
+}
+
+// deleteAccount は退会させる。すべてのセッションを失効させ、del_flg を立てるのでトークンも使えなくなる
+func deleteAccount(me User, password, confirmation string) error {
+	if me.Authority == 1 {
+		return errAdminCannotDelete
+	}
+	if ok, _ := verifyPassword(me, password); !ok {
+		return errWrongPassword
+	}
+	if confirmation != me.AccountName {
+		return errDeleteConfirmation
+	}
+
+	if _, err := db.Exec("UPDATE `users` SET `del_flg` = 1, `ban_expires_at` = NULL WHERE `id` = ?", me.ID); err != nil {
+		return err
+	}
+	invalidateUser(strconv.Itoa(me.ID))
+	if err := revokeUserSessions(me.ID); err != nil {
+		return err
+	}
+	publishTimelineDirty("delete")
+	return nil
+}
+
+var (
+	settingsTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("settings.html"),
+	))
+)
+
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	settingsTemplate.Execute(w, struct {
+		Me        User
+		Flash     string
+		CSRFToken string
+	}{me, getFlash(w, r, "notice"), getCSRFToken(r)})
+}
+
+// settingsAction は設定の変更を行うハンドラを作る。検証エラーは設定ページに表示する
+func settingsAction(success string, f func(w http.ResponseWriter, r *http.Request, me User) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		me := getSessionUser(r)
+		if !isLogin(me) {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		if r.FormValue("csrf_token") != getCSRFToken(r) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		err := f(w, r, me)
+		var verr validationError
+		if errors.As(err, &verr) {
+			session := getSession(r)
+			session.Values["notice"] = verr.Error()
+			session.Save(r, w)
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return
+		}
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, success, http.StatusFound)
+	}
+}
+
+var (
+	postSettingsPassword = settingsAction("/settings", func(w http.ResponseWriter, r *http.Request, me User) error {
+		return changePassword(me, r.FormValue("current_password"), r.FormValue("password"))
+	})
+	postSettingsAccountName = settingsAction("/settings", func(w http.ResponseWriter, r *http.Request, me User) error {
+		return changeAccountName(me, r.FormValue("account_name"), r.FormValue("password"))
+	})
+	postSettingsDelete = settingsAction("/", func(w http.ResponseWriter, r *http.Request, me User) error {
+		if err := deleteAccount(me, r.FormValue("password"), r.FormValue("confirm_account_name")); err != nil {
+			return err
+		}
+
+		endSession(w, r)
+		return nil
+	})
+)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timelineQuery は投稿一覧を取得するときの条件。
+// トップページ・ユーザーページ・もっと見る・投稿単体ページはすべてこれを通して取得する。
+type timelineQuery struct {
+	// 0 のときは全ユーザー
+	UserID int
+	// 0 のときは指定しない
+	PostID int
+	// ゼロ値のときは指定しない。指定した時刻以前の投稿だけを返す
+	MaxCreatedAt time.Time
+	// nil のときは指定しない。カーソルより古い投稿だけを返す
+	Before *timelineCursor
+	// BAN されたユーザーの投稿を含めるかどうか
+	IncludeBanned bool
+	// 1投稿あたりに取得するコメント数。0 のときは全件
+	CommentsPerPost int
+	// 取得する投稿数
+	Limit int
+}
+
+const (
+	timelinePostColumns = "`posts`.`id`, `posts`.`user_id`, `posts`.`body`, `posts`.`mime`, `posts`.`created_at`, " +
+		"`users`.`id` AS `user.id`, `users`.`account_name` AS `user.account_name`, `users`.`authority` AS `user.authority`, `users`.`del_flg` AS `user.del_flg`, `users`.`created_at` AS `user.created_at`"
+	timelineCommentColumns = "`comments`.`id` AS `comment.id`, `comments`.`user_id` AS `comment.user_id`, `comments`.`comment` AS `comment.comment`, `comments`.`created_at` AS `comment.created_at`, " +
+		"`users`.`id` AS `comment.user.id`, `users`.`account_name` AS `comment.user.account_name`, `users`.`authority` AS `comment.user.authority`, `users`.`del_flg` AS `comment.user.del_flg`, `users`.`created_at` AS `comment.user.created_at`"
+)
+
+// build は SQL とプレースホルダに渡す値を返す
+func (q timelineQuery) build() (string, []interface{}) {
+	where := []string{}
+	args := []interface{}{}
+
+	if !q.IncludeBanned {
+		where = append(where, activeUserCondition)
+	}
+	if q.UserID != 0 {
+		where = append(where, "`posts`.`user_id` = ?")
+		args = append(args, q.UserID)
+	}
+	if q.PostID != 0 {
+		where = append(where, "`posts`.`id` = ?")
+		args = append(args, q.PostID)
+	}
+	if !q.MaxCreatedAt.IsZero() {
+		where = append(where, "`posts`.`created_at` <= ?")
+		args = append(args, q.MaxCreatedAt.Format(ISO8601Format))
+	}
+	if q.Before != nil {
+		where = append(where, "(`posts`.`created_at` < ? OR (`posts`.`created_at` = ? AND `posts`.`id` < ?))")
+		args = append(args, q.Before.CreatedAt, q.Before.CreatedAt, q.Before.ID)
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = postsPerPage
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("WITH pu AS ( SELECT " + timelinePostColumns + " ")
+	sb.WriteString("FROM `posts` JOIN `users` ON `users`.`id` = `posts`.`user_id` ")
+	if len(where) > 0 {
+		sb.WriteString("WHERE " + strings.Join(where, " AND ") + " ")
+	}
+	sb.WriteString("ORDER BY `posts`.`created_at` DESC, `posts`.`id` DESC LIMIT ? ), ")
+	args = append(args, limit)
+
+	// コメントは新しいものから数えて rn を振り、表示は古い順にする
+	sb.WriteString("pc AS ( SELECT pu.*, " + timelineCommentColumns + ", ")
+	sb.WriteString("ROW_NUMBER() OVER (PARTITION BY pu.id ORDER BY `comments`.`created_at` DESC, `comments`.`id` DESC) AS rn, ")
+	sb.WriteString("COUNT(`comments`.`id`) OVER (PARTITION BY pu.id) AS comment_count ")
+	sb.WriteString("FROM pu ")
+	sb.WriteString("LEFT JOIN `comments` ON `comments`.`post_id` = pu.`id` ")
+	sb.WriteString("LEFT JOIN `users` ON `users`.`id` = `comments`.`user_id` ) ")
+
+	sb.WriteString("SELECT * FROM pc ")
+	if q.CommentsPerPost > 0 {
+		sb.WriteString("WHERE (rn <= ? OR rn IS NULL) ")
+		args = append(args, q.CommentsPerPost)
+	}
+	sb.WriteString("ORDER BY pc.`created_at` DESC, pc.`id` DESC, pc.`comment.created_at` ASC, pc.`comment.id` ASC")
+
+	return sb.String(), args
+}
+
+// selectTimeline は q に一致する投稿をコメント付きで返す
+func selectTimeline(q timelineQuery, csrfToken string) ([]Post, error) {
+	query, args := q.build()
+
+	results := []Post{}
+	err := db.Select(&results, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return makePosts(results, csrfToken)
+}
+
+// timelineCursor は一覧の最後に表示した投稿を指す。
+// created_at が同じ投稿があっても id で順序が決まるので、ページ間で重複も欠落もしない。
+type timelineCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func newTimelineCursor(p Post) *timelineCursor {
+	return &timelineCursor{CreatedAt: p.CreatedAt, ID: p.ID}
+}
+
+// nextTimelineCursor は次のページがありそうなら最後の投稿を指すカーソルを返す
+func nextTimelineCursor(posts []Post, limit int) string {
+	if len(posts) == 0 || len(posts) < limit {
+		return ""
+	}
+	return newTimelineCursor(posts[len(posts)-1]).Encode()
+}
+
+// Encode はURLにそのまま載せられる不透明な文字列にする
+func (c *timelineCursor) Encode() string {
+	s := c.CreatedAt.Format(time.RFC3339Nano) + "_" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeTimelineCursor(s string) (*timelineCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	createdAt, id, ok := strings.Cut(string(b), "_")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	pid, err := strconv.Atoi(id)
+	if err != nil || pid <= 0 {
+		return nil, errInvalidCursor
+	}
+
+	return &timelineCursor{CreatedAt: t, ID: pid}, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimelineQueryBuild(t *testing.T) {
+	maxCreatedAt := time.Date(2016, time.January, 2, 11, 46, 21, 0, time.FixedZone("Asia/Tokyo", 9*60*60))
+
+	tests := []struct {
+		name     string
+		q        timelineQuery
+		contains []string
+		excludes []string
+		args     []interface{}
+	}{
+		{
+			name:     "index",
+			q:        timelineQuery{CommentsPerPost: 3, Limit: 20},
+			contains: []string{activeUserCondition, "LIMIT ?", "(rn <= ? OR rn IS NULL)"},
+			excludes: []string{"`posts`.`user_id` = ?", "`posts`.`id` = ?", "`posts`.`created_at` <= ?"},
+			args:     []interface{}{20, 3},
+		},
+		{
+			name:     "user",
+			q:        timelineQuery{UserID: 7, CommentsPerPost: 3, Limit: 20},
+			contains: []string{activeUserCondition + " AND `posts`.`user_id` = ?"},
+			args:     []interface{}{7, 20, 3},
+		},
+		{
+			name:     "cursor",
+			q:        timelineQuery{MaxCreatedAt: maxCreatedAt, CommentsPerPost: 3},
+			contains: []string{"`posts`.`created_at` <= ?"},
+			args:     []interface{}{"2016-01-02T11:46:21+09:00", postsPerPage, 3},
+		},
+		{
+			name:     "post with all comments",
+			q:        timelineQuery{PostID: 42, Limit: 1},
+			contains: []string{"`posts`.`id` = ?"},
+			excludes: []string{"rn <= ?"},
+			args:     []interface{}{42, 1},
+		},
+		{
+			name:     "include banned",
+			q:        timelineQuery{IncludeBanned: true, Limit: 20},
+			excludes: []string{activeUserCondition, "del_flg` = 0 "},
+			args:     []interface{}{20},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := tt.q.build()
+			for _, s := range tt.contains {
+				if !strings.Contains(query, s) {
+					t.Errorf("expected query to contain %q: %s", s, query)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(query, s) {
+					t.Errorf("expected query not to contain %q: %s", s, query)
+				}
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("expected args %v to eq %v", args, tt.args)
+			}
+			if got, want := strings.Count(query, "?"), len(args); got != want {
+				t.Errorf("expected %d placeholders to eq %d args", got, want)
+			}
+		})
+	}
+}
+
+func TestMakePosts(t *testing.T) {
+	older := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	comment := func(id int, text, author string) NullComment {
+		return NullComment{
+			ID:      sql.NullInt64{Int64: int64(id), Valid: true},
+			Comment: sql.NullString{String: text, Valid: true},
+			User:    NullUser{AccountName: sql.NullString{String: author, Valid: true}},
+		}
+	}
+
+	results := []Post{
+		{ID: 1, CreatedAt: older, Comment: comment(10, "a", "alice")},
+		{ID: 2, CreatedAt: newer},
+		{ID: 1, CreatedAt: older, Comment: comment(11, "b", "bob")},
+		{ID: 3, CreatedAt: newer},
+	}
+
+	posts, err := makePosts(results, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []int{}
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+		if p.CSRFToken != "token" {
+			t.Errorf("expected CSRFToken %q to eq %q", p.CSRFToken, "token")
+		}
+	}
+	if !reflect.DeepEqual(ids, []int{3, 2, 1}) {
+		t.Errorf("expected order %v to eq %v", ids, []int{3, 2, 1})
+	}
+
+	want := []Comment{{ID: 10, Comment: "a", AuthorName: "alice"}, {ID: 11, Comment: "b", AuthorName: "bob"}}
+	if !reflect.DeepEqual(posts[2].Comments, want) {
+		t.Errorf("expected comments %v to eq %v", posts[2].Comments, want)
+	}
+}
+
+func TestTimelineCursor(t *testing.T) {
+	c := &timelineCursor{
+		CreatedAt: time.Date(2016, time.January, 2, 11, 46, 21, 0, time.FixedZone("Asia/Tokyo", 9*60*60)),
+		ID:        10000,
+	}
+
+	got, err := decodeTimelineCursor(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(c.CreatedAt) || got.ID != c.ID {
+		t.Errorf("expected %v to eq %v", got, c)
+	}
+
+	for _, s := range []string{"", "!!", "MjAxNg", "bm90LWEtdGltZV8x"} {
+		if _, err := decodeTimelineCursor(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestNextTimelineCursor(t *testing.T) {
+	posts := []Post{{ID: 2}, {ID: 1}}
+
+	if got := nextTimelineCursor(posts, 3); got != "" {
+		t.Errorf("expected no cursor for a short page, got %q", got)
+	}
+
+	c, err := decodeTimelineCursor(nextTimelineCursor(posts, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != 1 {
+		t.Errorf("expected cursor to point at %d, got %d", 1, c.ID)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 個人用アクセストークン。Authorization: Bearer で送られたときは CSRF トークンを確かめない。
+// トークンそのものは作成時に一度だけ表示し、DBにはハッシュだけを保存する。
+
+type tokenScope string
+
+const (
+	// セッションでのみ許可する操作に使う
+	tokenScopeNone    tokenScope = ""
+	tokenScopeRead    tokenScope = "read"
+	tokenScopePost    tokenScope = "post"
+	tokenScopeComment tokenScope = "comment"
+
+	accessTokenPrefix = "isup_"
+)
+
+var (
+	tokenScopes = []tokenScope{tokenScopeRead, tokenScopePost, tokenScopeComment}
+
+	errAccessTokenInvalid = errors.New("invalid access token")
+	errAccessTokenScope   = errors.New("access token scope is insufficient")
+)
+
+type AccessToken struct {
+	ID         int          `db:"id"`
+	UserID     int          `db:"user_id"`
+	Name       string       `db:"name"`
+	TokenHash  string       `db:"token_hash"`
+	Scopes     string       `db:"scopes"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+	RevokedAt  sql.NullTime `db:"revoked_at"`
+}
+
+func (t AccessToken) ScopeList() []tokenScope {
+	scopes := []tokenScope{}
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s != "" {
+			scopes = append(scopes, tokenScope(s))
+		}
+	}
+	return scopes
+}
+
+// hasScope は投稿やコメントのスコープを持っていれば読み取りも許可する
+func (t AccessToken) hasScope(scope tokenScope) bool {
+	if scope == tokenScopeNone {
+		return false
+	}
+	scopes := t.ScopeList()
+	if scope == tokenScopeRead && len(scopes) > 0 {
+		return true
+	}
+	return slices.Contains(scopes, scope)
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseTokenScopes(values []string) ([]tokenScope, error) {
+	scopes := []tokenScope{}
+	for _, v := range values {
+		s := tokenScope(v)
+		if !slices.Contains(tokenScopes, s) {
+			return nil, validationError("不明なスコープです: " + v)
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, validationError("スコープを1つ以上選んでください")
+	}
+	return scopes, nil
+}
+
+// createAccessToken は新しいトークンを発行し、その ID と平文のトークンを返す
+func createAccessToken(userID int, name string, scopes []tokenScope) (int, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 64 {
+		return 0, "", validationError("トークン名は1文字以上64文字以下である必要があります")
+	}
+
+	s := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		s = append(s, string(scope))
+	}
+
+	token := accessTokenPrefix + secureRandomStr(20)
+	result, err := db.Exec(
+		"INSERT INTO `access_tokens` (`user_id`, `name`, `token_hash`, `scopes`) VALUES (?,?,?,?)",
+		userID, name, hashAccessToken(token), strings.Join(s, ","),
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	return int(id), token, nil
+}
+
+func listAccessTokens(userID int) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	err := db.Select(&tokens, "SELECT * FROM `access_tokens` WHERE `user_id` = ? AND `revoked_at` IS NULL ORDER BY `created_at` DESC, `id` DESC", userID)
+	return tokens, err
+}
+
+// revokeAccessToken は userID 自身のトークンだけを失効させる
+func revokeAccessToken(userID, id int) (bool, error) {
+	result, err := db.Exec("UPDATE `access_tokens` SET `revoked_at` = NOW() WHERE `id` = ? AND `user_id` = ? AND `revoked_at` IS NULL", id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// bearerToken は Authorization ヘッダが Bearer ならトークンを返す。
+// プロキシの Basic 認証など他の方式のときはセッションで認証させるため false を返す
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func authenticateAccessToken(token string, scope tokenScope) (User, error) {
+	if !strings.HasPrefix(token, accessTokenPrefix) {
+		return User{}, errAccessTokenInvalid
+	}
+
+	t := AccessToken{}
+	err := db.Get(&t, "SELECT * FROM `access_tokens` WHERE `token_hash` = ? AND `revoked_at` IS NULL", hashAccessToken(token))
+	if err == sql.ErrNoRows {
+		return User{}, errAccessTokenInvalid
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	u := User{}
+	err = db.Get(&u, "SELECT * FROM `users` WHERE `id` = ? AND "+activeUserCondition, t.UserID)
+	if err == sql.ErrNoRows {
+		return User{}, errAccessTokenInvalid
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if !t.hasScope(scope) {
+		return User{}, errAccessTokenScope
+	}
+
+	_, err = db.Exec("UPDATE `access_tokens` SET `last_used_at` = NOW() WHERE `id` = ?", t.ID)
+	if err != nil {
+		log.Print(err)
+	}
+
+	return u, nil
+}
+
+// getRequestUser はトークンかセッションで認証したユーザーを返す。
+// トークンで認証したときは tokenAuth が true になり、CSRF トークンの確認は不要になる。
+func getRequestUser(r *http.Request, scope tokenScope) (me User, tokenAuth bool, err error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return getSessionUser(r), false, nil
+	}
+	me, err = authenticateAccessToken(token, scope)
+	return me, true, err
+}
+
+// writeTokenAuthError はトークンでの認証に失敗したときのレスポンスを書く
+func writeTokenAuthError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errAccessTokenScope):
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, errAccessTokenInvalid):
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+var (
+	tokensTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("tokens.html"),
+	))
+)
+
+func getTokens(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	tokens, err := listAccessTokens(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	tokensTemplate.Execute(w, struct {
+		Me        User
+		Tokens    []AccessToken
+		Scopes    []tokenScope
+		NewToken  string
+		Flash     string
+		CSRFToken string
+	}{me, tokens, tokenScopes, getFlash(w, r, "new_token"), getFlash(w, r, "notice"), getCSRFToken(r)})
+}
+
+func postTokens(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+	scopes, err := parseTokenScopes(r.Form["scopes[]"])
+	if err == nil {
+		var token string
+		_, token, err = createAccessToken(me.ID, r.FormValue("name"), scopes)
+		if err == nil {
+			session.Values["new_token"] = token
+		}
+	}
+
+	var verr validationError
+	if errors.As(err, &verr) {
+		session.Values["notice"] = verr.Error()
+	} else if err != nil {
+		log.Print(err)
+		return
+	}
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/tokens", http.StatusFound)
+}
+
+func postTokensRevoke(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, err := revokeAccessToken(me.ID, id); err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/tokens", http.StatusFound)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessTokenHasScope(t *testing.T) {
+	tests := []struct {
+		scopes string
+		scope  tokenScope
+		want   bool
+	}{
+		{"read", tokenScopeRead, true},
+		{"read", tokenScopePost, false},
+		{"post", tokenScopeRead, true},
+		{"post", tokenScopePost, true},
+		{"post", tokenScopeComment, false},
+		{"post,comment", tokenScopeComment, true},
+		{"read,post,comment", tokenScopeNone, false},
+		{"", tokenScopeRead, false},
+	}
+
+	for _, tt := range tests {
+		got := AccessToken{Scopes: tt.scopes}.hasScope(tt.scope)
+		if got != tt.want {
+			t.Errorf("expected %q.hasScope(%q) to eq %v", tt.scopes, tt.scope, tt.want)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"", "", false},
+		{"Bearer isup_abc", "isup_abc", true},
+		{"bearer  isup_abc ", "isup_abc", true},
+		{"Bearer", "", true},
+		{"Basic dXNlcjpwYXNz", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		token, ok := bearerToken(r)
+		if token != tt.token || ok != tt.ok {
+			t.Errorf("expected bearerToken(%q) to eq (%q, %v), got (%q, %v)", tt.header, tt.token, tt.ok, token, ok)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// RFC 6238 の TOTP による2段階認証。
+// 有効にしたアカウントはパスワードが通ったあとにワンタイムパスワードかリカバリーコードを求める。
+// ISUCONP_REQUIRE_2FA_FOR_ADMINS=1 のときは、2段階認証を有効にしていない管理者は管理者用ページを使えない。
+
+const (
+	totpIssuer        = "Iscogram"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+
+	// パスワードが通ってから2段階目を終えるまでの猶予
+	pendingLoginTTL = 5 * time.Minute
+)
+
+var (
+	twoFactorRequiredForAdmins = os.Getenv("ISUCONP_REQUIRE_2FA_FOR_ADMINS") == "1"
+
+	errTwoFactorCode     validationError = "確認コードが正しくありません"
+	errTwoFactorEnrolled validationError = "2段階認証はすでに有効です"
+	errTwoFactorRequired validationError = "管理者は2段階認証を有効にする必要があります"
+)
+
+type TwoFactor struct {
+	UserID       int          `db:"user_id"`
+	Secret       string       `db:"secret"`
+	LastUsedStep int64        `db:"last_used_step"`
+	EnabledAt    sql.NullTime `db:"enabled_at"`
+	CreatedAt    time.Time    `db:"created_at"`
+}
+
+func generateTOTPSecret() string {
+	k := make([]byte, 20)
+	if _, err := crand.Read(k); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(k)
+}
+
+// totpCode は secret の step 番目のコードを返す
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000), nil
+}
+
+// matchTOTP は前後 totpSkew ステップまでのずれを許してコードを確かめ、一致したステップを返す。
+// lastUsedStep 以前のステップは使用済みとして受け付けない。
+func matchTOTP(secret, code string, now time.Time, lastUsedStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			log.Print(err)
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpProvisioningURI(accountName, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+accountName) + "?" + v.Encode()
+}
+
+func getTwoFactor(userID int) (TwoFactor, error) {
+	t := TwoFactor{}
+	err := db.Get(&t, "SELECT * FROM `two_factors` WHERE `user_id` = ?", userID)
+	return t, err
+}
+
+func isTwoFactorEnabled(userID int) (bool, error) {
+	t, err := getTwoFactor(userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t.EnabledAt.Valid, nil
+}
+
+// startTwoFactorEnrollment は有効化前の secret を返す。まだ無ければ作る
+func startTwoFactorEnrollment(userID int) (string, error) {
+	t, err := getTwoFactor(userID)
+	if err == nil {
+		if t.EnabledAt.Valid {
+			return "", errTwoFactorEnrolled
+		}
+		return t.Secret, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	secret := generateTOTPSecret()
+	_, err = db.Exec("INSERT INTO `two_factors` (`user_id`, `secret`) VALUES (?,?)", userID, secret)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// enableTwoFactor は登録中の secret でコードを確かめて有効にし、リカバリーコードを返す
+func enableTwoFactor(userID int, code string) ([]string, error) {
+	t, err := getTwoFactor(userID)
+	if err == sql.ErrNoRows {
+		return nil, errTwoFactorCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.EnabledAt.Valid {
+		return nil, errTwoFactorEnrolled
+	}
+
+	step, ok := matchTOTP(t.Secret, code, time.Now(), t.LastUsedStep)
+	if !ok {
+		return nil, errTwoFactorCode
+	}
+
+	_, err = db.Exec("UPDATE `two_factors` SET `enabled_at` = NOW(), `last_used_step` = ? WHERE `user_id` = ? AND `enabled_at` IS NULL", step, userID)
+	if err != nil {
+		return nil, err
+	}
+	return generateRecoveryCodes(userID)
+}
+
+func disableTwoFactor(userID int) error {
+	if _, err := db.Exec("DELETE FROM `two_factors` WHERE `user_id` = ?", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM `recovery_codes` WHERE `user_id` = ?", userID)
+	return err
+}
+
+// verifySecondFactor はワンタイムパスワードかリカバリーコードを確かめる。
+// どちらも一度使ったものは二度と通さない。
+func verifySecondFactor(userID int, code string) (bool, error) {
+	t, err := getTwoFactor(userID)
+	if err == sql.ErrNoRows || (err == nil && !t.EnabledAt.Valid) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := matchTOTP(t.Secret, code, time.Now(), t.LastUsedStep); ok {
+		result, err := db.Exec("UPDATE `two_factors` SET `last_used_step` = ? WHERE `user_id` = ? AND `last_used_step` < ?", step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n > 0, err
+	}
+
+	return useRecoveryCode(userID, code)
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// generateRecoveryCodes は以前のリカバリーコードを捨てて新しく作る
+func generateRecoveryCodes(userID int) ([]string, error) {
+	if _, err := db.Exec("DELETE FROM `recovery_codes` WHERE `user_id` = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		s := secureRandomStr(5)
+		code := s[:5] + "-" + s[5:]
+		_, err := db.Exec("INSERT INTO `recovery_codes` (`user_id`, `code_hash`) VALUES (?,?)", userID, hashAccessToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func useRecoveryCode(userID int, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return false, nil
+	}
+	result, err := db.Exec("UPDATE `recovery_codes` SET `used_at` = NOW() WHERE `user_id` = ? AND `code_hash` = ? AND `used_at` IS NULL", userID, hashAccessToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func countRecoveryCodes(userID int) (int, error) {
+	n := 0
+	err := db.Get(&n, "SELECT COUNT(*) FROM `recovery_codes` WHERE `user_id` = ? AND `used_at` IS NULL", userID)
+	return n, err
+}
+
+// needsTwoFactorEnrollment は管理者に2段階認証を必須にしていて、まだ有効にしていないかを返す
+func needsTwoFactorEnrollment(u User) (bool, error) {
+	if !twoFactorRequiredForAdmins || u.Authority == 0 {
+		return false, nil
+	}
+	enabled, err := isTwoFactorEnabled(u.ID)
+	return !enabled, err
+}
+
+// requireAdminTwoFactor は2段階認証が必要な管理者を設定ページに送る。続けてよければ true を返す
+func requireAdminTwoFactor(w http.ResponseWriter, r *http.Request, me User) bool {
+	needs, err := needsTwoFactorEnrollment(me)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if !needs {
+		return true
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = errTwoFactorRequired.Error()
+	session.Save(r, w)
+	http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+	return false
+}
+
+// beginPendingLogin はパスワードが通ったユーザーを2段階目の待ちにする
+func beginPendingLogin(w http.ResponseWriter, r *http.Request, u User) {
+	session := getSession(r)
+	delete(session.Values, "user_id")
+	session.Values["pending_user_id"] = u.ID
+	session.Values["pending_at"] = time.Now().Unix()
+	session.Save(r, w)
+}
+
+// getPendingLoginUser は2段階目を待っているユーザーを返す。期限切れなら ID が 0 のユーザーを返す
+func getPendingLoginUser(r *http.Request) User {
+	session := getSession(r)
+	uid, ok := session.Values["pending_user_id"].(int)
+	if !ok {
+		return User{}
+	}
+	at, ok := session.Values["pending_at"].(int64)
+	if !ok || time.Since(time.Unix(at, 0)) > pendingLoginTTL {
+		return User{}
+	}
+
+	u := User{}
+	err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ? AND "+activeUserCondition, uid)
+	if err != nil {
+		return User{}
+	}
+	return u
+}
+
+func clearPendingLogin(r *http.Request) {
+	session := getSession(r)
+	delete(session.Values, "pending_user_id")
+	delete(session.Values, "pending_at")
+}
+
+var (
+	loginTwoFactorTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("login_2fa.html"),
+	))
+	twoFactorTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"userURL": userURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("two_factor.html"),
+	))
+)
+
+func getLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if !isLogin(getPendingLoginUser(r)) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	loginTwoFactorTemplate.Execute(w, struct {
+		Me    User
+		Flash string
+	}{User{}, getFlash(w, r, "notice")})
+}
+
+func postLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	u := getPendingLoginUser(r)
+	if !isLogin(u) {
+		session := getSession(r)
+		session.Values["notice"] = "もう一度ログインしてください"
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	ip := loginLimit.clientIP(r)
+	if retryAfter, locked := loginLimit.locked(u.AccountName, ip); locked {
+		renderLoginLimited(w, retryAfter)
+		return
+	}
+
+	ok, err := verifySecondFactor(u.ID, r.FormValue("code"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if !ok {
+		if retryAfter, locked := loginLimit.failed(u.AccountName, ip); locked {
+			renderLoginLimited(w, retryAfter)
+			return
+		}
+		session := getSession(r)
+		session.Values["notice"] = errTwoFactorCode.Error()
+		session.Save(r, w)
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+
+	loginLimit.succeeded(u.AccountName)
+	clearPendingLogin(r)
+	if _, err := startSession(w, r, u); err != nil {
+		log.Print(err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func getSettingsTwoFactor(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	enabled, err := isTwoFactorEnabled(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	var secret, uri string
+	var qr template.URL
+	remaining := 0
+	if enabled {
+		remaining, err = countRecoveryCodes(me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	} else {
+		secret, err = startTwoFactorEnrollment(me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		uri = totpProvisioningURI(me.AccountName, secret)
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		qr = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	var codes []string
+	if s := getFlash(w, r, "recovery_codes"); s != "" {
+		codes = strings.Split(s, "\n")
+	}
+
+	twoFactorTemplate.Execute(w, struct {
+		Me                User
+		Enabled           bool
+		Secret            string
+		ProvisioningURI   string
+		QRCode            template.URL
+		RecoveryCodes     []string
+		RemainingCodes    int
+		RequiredForAdmins bool
+		Flash             string
+		CSRFToken         string
+	}{me, enabled, secret, uri, qr, codes, remaining, twoFactorRequiredForAdmins && me.Authority == 1, getFlash(w, r, "notice"), getCSRFToken(r)})
+}
+
+func postSettingsTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	codes, err := enableTwoFactor(me.ID, r.FormValue("code"))
+	if !flashTwoFactorResult(w, r, codes, err) {
+		return
+	}
+	http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+}
+
+func postSettingsTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	err := func() error {
+		if twoFactorRequiredForAdmins && me.Authority == 1 {
+			return errTwoFactorRequired
+		}
+		if ok, _ := verifyPassword(me, r.FormValue("password")); !ok {
+			return validationError("パスワードが間違っています")
+		}
+		ok, err := verifySecondFactor(me.ID, r.FormValue("code"))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errTwoFactorCode
+		}
+		return disableTwoFactor(me.ID)
+	}()
+	if !flashTwoFactorResult(w, r, nil, err) {
+		return
+	}
+	http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+}
+
+func postSettingsTwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	codes, err := func() ([]string, error) {
+		ok, err := verifySecondFactor(me.ID, r.FormValue("code"))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errTwoFactorCode
+		}
+		return generateRecoveryCodes(me.ID)
+	}()
+	if !flashTwoFactorResult(w, r, codes, err) {
+		return
+	}
+	http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+}
+
+// flashTwoFactorResult は新しいリカバリーコードかエラーメッセージを次の表示のために残す。
+// 想定外のエラーのときは false を返す
+func flashTwoFactorResult(w http.ResponseWriter, r *http.Request, codes []string, err error) bool {
+	session := getSession(r)
+	var verr validationError
+	if errors.As(err, &verr) {
+		session.Values["notice"] = verr.Error()
+	} else if err != nil {
+		log.Print(err)
+		return false
+	}
+	if len(codes) > 0 {
+		session.Values["recovery_codes"] = strings.Join(codes, "\n")
+	}
+	session.Save(r, w)
+	return true
+}
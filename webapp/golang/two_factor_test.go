@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B の SHA1 のテストベクタ (下6桁)
+func TestTOTPCode(t *testing.T) {
+	// "12345678901234567890" の base32
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := generateTOTPSecret()
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / totpPeriod
+
+	code, err := totpCode(secret, step-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := matchTOTP(secret, code, now, 0); !ok || got != step-1 {
+		t.Errorf("expected the previous step to be accepted, got (%d, %v)", got, ok)
+	}
+	if _, ok := matchTOTP(secret, code, now, step-1); ok {
+		t.Error("expected a used step to be rejected")
+	}
+
+	code, err = totpCode(secret, step-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := matchTOTP(secret, code, now, 0); ok {
+		t.Error("expected a code outside the skew to be rejected")
+	}
+}
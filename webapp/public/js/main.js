@@ -23,24 +23,62 @@ timeago.register('ja', (number, index) => {
 document.addEventListener('DOMContentLoaded', () => {
   timeago.render(document.querySelectorAll('time.timeago'), 'ja');
 
+  document.querySelectorAll('.isu-comment-more-btn').forEach((commentBtn) => {
+    const commentMore = commentBtn.parentElement;
+    commentBtn.addEventListener('click', () => {
+      const postID = commentBtn.dataset.postId;
+      const cursor = commentBtn.dataset.nextCursor;
+      fetch(`/posts/${postID}/comments?cursor=${encodeURIComponent(cursor)}`, {
+        method: 'GET',
+      }).then(response => {
+        if (!response.ok) {
+          throw new Error('Network response was not ok');
+        }
+        commentBtn.dataset.nextCursor = response.headers.get('X-Next-Cursor') || '';
+        return response.text();
+      }).then(text => {
+        const parser = new DOMParser();
+        const doc = parser.parseFromString(text, "text/html");
+        doc.querySelectorAll('.isu-comment').forEach((el) => {
+          commentMore.before(el);
+        });
+        if (commentBtn.dataset.nextCursor === '') {
+          commentMore.remove();
+        }
+      });
+    });
+  });
+
   const btn = document.getElementById('isu-post-more-btn');
   const postMore = document.getElementById('isu-post-more');
 
   if (!btn) {
     return;
   }
+  if ('nextCursor' in btn.dataset && btn.dataset.nextCursor === '') {
+    postMore.style.display = 'none';
+    return;
+  }
 
   btn.addEventListener('click', () => {
     postMore.classList.add('loading');
     const posts = document.querySelectorAll('.isu-post');
     const lastEl = posts[posts.length-1];
-    const maxCreatedAt = lastEl.dataset.createdAt;
-    fetch(`/posts?max_created_at=${encodeURIComponent(maxCreatedAt)}`, {
+    // カーソルを返す実装ではカーソルを、そうでなければ最後の投稿の時刻を使う
+    const usesCursor = 'nextCursor' in btn.dataset;
+    const query = usesCursor
+      ? `cursor=${encodeURIComponent(btn.dataset.nextCursor)}`
+      : `max_created_at=${encodeURIComponent(lastEl.dataset.createdAt)}`;
+    const moreURL = btn.dataset.moreUrl || '/posts';
+    fetch(`${moreURL}?${query}`, {
       method: 'GET',
     }).then(response => {
       if (!response.ok) {
         throw new Error('Network response was not ok');
       }
+      if (usesCursor) {
+        btn.dataset.nextCursor = response.headers.get('X-Next-Cursor') || '';
+      }
       return response.text();
     }).then(text => {
       const parser = new DOMParser();
@@ -53,6 +91,9 @@ document.addEventListener('DOMContentLoaded', () => {
       });
       timeago.render(document.querySelectorAll('time.timeago'), 'ja');
       postMore.classList.remove('loading');
+      if (usesCursor && btn.dataset.nextCursor === '') {
+        postMore.style.display = 'none';
+      }
     });
   });
 });